@@ -0,0 +1,637 @@
+package interceptify
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+	"github.com/spf13/cobra"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Manage the Interceptify certificate authority",
+	Long:  `Create, inspect, and maintain the certificate authority used to mint intercepted TLS certificates.`,
+}
+
+var caInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate a new root CA",
+	Long:  `Generate a new self-signed root CA with the chosen subject, key type, and validity.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, keyPath := caFilePaths(cmd)
+		force, _ := cmd.Flags().GetBool("force")
+
+		if _, err := os.Stat(certPath); err == nil && !force {
+			fmt.Printf("A CA already exists at %s; use --force to overwrite it or 'ca rotate' to archive it\n", certPath)
+			return
+		}
+
+		cfg, err := rootConfigFromFlags(cmd)
+		if err != nil {
+			fmt.Printf("Invalid CA options: %v\n", err)
+			return
+		}
+
+		cert, err := generateRoot(cfg, certPath, keyPath)
+		if err != nil {
+			fmt.Printf("Failed to generate CA: %v\n", err)
+			return
+		}
+
+		fmt.Printf("Root CA %q written to %s (key: %s)\n", cert.Subject.CommonName, certPath, keyPath)
+		printCertificate(cert)
+	},
+}
+
+var caInfoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the CA subject, fingerprints, and expiry",
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, keyPath := caFilePaths(cmd)
+
+		caInstance, err := loadCA(cmd)
+		if err != nil {
+			fmt.Printf("Failed to load CA: %v\n", err)
+			return
+		}
+
+		encrypted, _ := ca.IsKeyEncrypted(keyPath)
+		fmt.Printf("Certificate: %s\n", certPath)
+		fmt.Printf("Key:         %s (encrypted: %t)\n", keyPath, encrypted)
+		printCertificate(caInstance.Cert)
+		for _, cert := range caInstance.Chain {
+			fmt.Println()
+			fmt.Println("Issued by:")
+			printCertificate(cert)
+		}
+	},
+}
+
+var caExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the CA certificate as PEM, DER, or PKCS#12",
+	Long: `Export the CA certificate for installation on clients.
+
+Every format exports only the certificate and its chain unless --include-key
+is given (PEM and PKCS#12 only). A PEM key stays encrypted with the CA
+passphrase if the stored key is encrypted, unless --no-encrypt is given. A
+PKCS#12 bundle with a key must be protected by a non-empty --password.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		format, _ := cmd.Flags().GetString("format")
+		out, _ := cmd.Flags().GetString("out")
+		includeKey, _ := cmd.Flags().GetBool("include-key")
+		noEncrypt, _ := cmd.Flags().GetBool("no-encrypt")
+		password, _ := cmd.Flags().GetString("password")
+
+		caInstance, passphrase, err := loadCAWithPassphrase(cmd)
+		if err != nil {
+			fmt.Printf("Failed to load CA: %v\n", err)
+			return
+		}
+
+		var data []byte
+		perm := os.FileMode(0644)
+		switch strings.ToLower(format) {
+		case "pem":
+			data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caInstance.Cert.Raw})
+			for _, cert := range caInstance.Chain {
+				data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+			}
+			if includeKey {
+				// Keep a protected key protected in the export
+				var keyBlock *pem.Block
+				if passphrase != nil && !noEncrypt {
+					keyBlock, err = ca.EncryptKeyPEM(caInstance.Key, passphrase)
+				} else {
+					keyBlock, err = ca.MarshalKeyPEM(caInstance.Key)
+				}
+				if err != nil {
+					fmt.Printf("Failed to encode key: %v\n", err)
+					return
+				}
+				data = append(data, pem.EncodeToMemory(keyBlock)...)
+				perm = 0600
+			}
+		case "der":
+			if includeKey {
+				fmt.Println("--include-key is not supported for DER export")
+				return
+			}
+			data = caInstance.Cert.Raw
+		case "p12", "pkcs12", "pfx":
+			encoder := pkcs12.Modern2023.WithRand(rand.Reader)
+			if includeKey {
+				if password == "" {
+					fmt.Println("A PKCS#12 bundle including the key needs a non-empty --password")
+					return
+				}
+				data, err = encoder.Encode(caInstance.Key, caInstance.Cert, caInstance.Chain, password)
+			} else {
+				certs := append([]*x509.Certificate{caInstance.Cert}, caInstance.Chain...)
+				data, err = encoder.EncodeTrustStore(certs, password)
+			}
+			if err != nil {
+				fmt.Printf("Failed to encode PKCS#12: %v\n", err)
+				return
+			}
+			perm = 0600
+		default:
+			fmt.Printf("Unsupported export format %q (expected pem, der, or p12)\n", format)
+			return
+		}
+
+		if out == "" || out == "-" {
+			os.Stdout.Write(data)
+			return
+		}
+		if err := os.WriteFile(out, data, perm); err != nil {
+			fmt.Printf("Failed to write %s: %v\n", out, err)
+			return
+		}
+		fmt.Printf("Exported CA as %s to %s\n", strings.ToLower(format), out)
+	},
+}
+
+var caRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Archive the current CA and generate a new one",
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, keyPath := caFilePaths(cmd)
+
+		cfg, err := rootConfigFromFlags(cmd)
+		if err != nil {
+			fmt.Printf("Invalid CA options: %v\n", err)
+			return
+		}
+
+		// The new CA is generated next to the current one first, so that a
+		// failure leaves the current CA in place
+		newCertPath, newKeyPath := certPath+".new", keyPath+".new"
+		defer os.Remove(newCertPath)
+		defer os.Remove(newKeyPath)
+		cert, err := generateRoot(cfg, newCertPath, newKeyPath)
+		if err != nil {
+			fmt.Printf("Failed to generate CA: %v\n", err)
+			return
+		}
+
+		archiveDir := filepath.Join(filepath.Dir(certPath), "archive", time.Now().Format("20060102-150405"))
+		if err := os.MkdirAll(archiveDir, 0700); err != nil {
+			fmt.Printf("Failed to create archive directory: %v\n", err)
+			return
+		}
+		for _, path := range []string{certPath, keyPath} {
+			if err := os.Rename(path, filepath.Join(archiveDir, filepath.Base(path))); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("Failed to archive %s: %v\n", path, err)
+				return
+			}
+		}
+		fmt.Printf("Archived previous CA to %s\n", archiveDir)
+
+		for _, move := range [][2]string{{newKeyPath, keyPath}, {newCertPath, certPath}} {
+			if err := os.Rename(move[0], move[1]); err != nil {
+				fmt.Printf("Failed to install new CA file %s: %v (the previous CA is in %s)\n", move[1], err, archiveDir)
+				return
+			}
+		}
+
+		fmt.Printf("New root CA %q written to %s; clients must trust the new certificate\n", cert.Subject.CommonName, certPath)
+		printCertificate(cert)
+	},
+}
+
+var caSignCmd = &cobra.Command{
+	Use:   "sign <host>",
+	Short: "Mint a leaf certificate for a host for offline use",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		host := args[0]
+		outCert, _ := cmd.Flags().GetString("out-cert")
+		outKey, _ := cmd.Flags().GetString("out-key")
+		keyTypeName, _ := cmd.Flags().GetString("key-type")
+		if outCert == "" {
+			outCert = host + ".crt"
+		}
+		if outKey == "" {
+			outKey = host + ".key"
+		}
+
+		keyType, err := ca.ParseKeyType(keyTypeName)
+		if err != nil {
+			fmt.Printf("Invalid key type: %v\n", err)
+			return
+		}
+
+		caInstance, err := loadCA(cmd)
+		if err != nil {
+			fmt.Printf("Failed to load CA: %v\n", err)
+			return
+		}
+		caInstance.LeafKeyType = keyType
+
+		tlsCert, err := caInstance.Certificate(host)
+		if err != nil {
+			fmt.Printf("Failed to sign certificate for %s: %v\n", host, err)
+			return
+		}
+
+		var certPEM []byte
+		for _, der := range tlsCert.Certificate {
+			certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+		}
+		keyBlock, err := ca.MarshalKeyPEM(tlsCert.PrivateKey.(crypto.Signer))
+		if err != nil {
+			fmt.Printf("Failed to encode key: %v\n", err)
+			return
+		}
+
+		if err := os.WriteFile(outCert, certPEM, 0644); err != nil {
+			fmt.Printf("Failed to write %s: %v\n", outCert, err)
+			return
+		}
+		if err := os.WriteFile(outKey, pem.EncodeToMemory(keyBlock), 0600); err != nil {
+			fmt.Printf("Failed to write %s: %v\n", outKey, err)
+			return
+		}
+
+		fmt.Printf("Certificate for %s written to %s (key: %s)\n", host, outCert, outKey)
+		printCertificate(tlsCert.Leaf)
+	},
+}
+
+var caIntermediateCmd = &cobra.Command{
+	Use:   "intermediate",
+	Short: "Generate an intermediate CA signed by an existing root",
+	Long: `Generate an intermediate CA signed by an existing (possibly offline) root CA.
+
+The intermediate certificate, followed by the root, is written to the proxy's
+CA certificate path and only the intermediate key is written next to it, so
+the root key never has to be present while the proxy runs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, keyPath := caFilePaths(cmd)
+		rootCert, _ := cmd.Flags().GetString("root-cert")
+		rootKey, _ := cmd.Flags().GetString("root-key")
+		rootPassphraseFile, _ := cmd.Flags().GetString("root-passphrase-file")
+		passphraseFile, _ := cmd.Flags().GetString("ca-passphrase-file")
+		encrypt, _ := cmd.Flags().GetBool("encrypt")
+		force, _ := cmd.Flags().GetBool("force")
+		keyTypeName, _ := cmd.Flags().GetString("key-type")
+		days, _ := cmd.Flags().GetInt("days")
+
+		// Writing over the root would destroy the key the chain is signed by
+		for _, out := range []string{certPath, keyPath} {
+			if sameFile(out, rootCert) || sameFile(out, rootKey) {
+				fmt.Printf("Refusing to overwrite the root CA at %s; choose another --ca-cert/--ca-key\n", out)
+				return
+			}
+		}
+		if !force {
+			for _, out := range []string{certPath, keyPath} {
+				if _, err := os.Stat(out); err == nil {
+					fmt.Printf("A CA already exists at %s; use --force to overwrite it or 'ca rotate' to archive it\n", out)
+					return
+				}
+			}
+		}
+
+		keyType, err := ca.ParseKeyType(keyTypeName)
+		if err != nil {
+			fmt.Printf("Invalid key type: %v\n", err)
+			return
+		}
+
+		rootPassphrase, err := keyPassphrase(rootKey, rootPassphraseFile)
+		if err != nil {
+			fmt.Printf("Failed to read root CA passphrase: %v\n", err)
+			return
+		}
+		root, err := ca.LoadCAWithPassphrase(rootCert, rootKey, rootPassphrase)
+		if err != nil {
+			fmt.Printf("Failed to load root CA: %v\n", err)
+			return
+		}
+
+		passphrase, err := newKeyPassphrase(passphraseFile, encrypt)
+		if err != nil {
+			fmt.Printf("Failed to read CA passphrase: %v\n", err)
+			return
+		}
+
+		cfg := ca.DefaultConfig()
+		cfg.RootKeyType = keyType
+		cert, key, err := ca.GenerateIntermediateCA(root, cfg, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			fmt.Printf("Failed to generate intermediate CA: %v\n", err)
+			return
+		}
+
+		chain := append([]*x509.Certificate{cert, root.Cert}, root.Chain...)
+		if err := ca.SaveCAChain(chain, key, certPath, keyPath, passphrase); err != nil {
+			fmt.Printf("Failed to save intermediate CA: %v\n", err)
+			return
+		}
+
+		fmt.Printf("Intermediate CA %q written to %s (key: %s)\n", cert.Subject.CommonName, certPath, keyPath)
+		printCertificate(cert)
+	},
+}
+
+var caEncryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt (or re-encrypt) the CA private key with a passphrase",
+	Long: `Rewrite the CA private key as passphrase-encrypted PKCS#8.
+
+The current key is loaded (decrypting it first if needed) and written back
+encrypted with a new passphrase, read from --new-passphrase-file or prompted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, keyPath := caFilePaths(cmd)
+		newPassphraseFile, _ := cmd.Flags().GetString("new-passphrase-file")
+
+		caInstance, err := loadCA(cmd)
+		if err != nil {
+			fmt.Printf("Failed to load CA: %v\n", err)
+			return
+		}
+
+		var passphrase []byte
+		if newPassphraseFile != "" {
+			passphrase, err = configuredPassphrase(newPassphraseFile)
+		} else {
+			passphrase, err = promptPassphrase("New CA key passphrase: ", true)
+		}
+		if err != nil {
+			fmt.Printf("Failed to read new passphrase: %v\n", err)
+			return
+		}
+
+		chain := append([]*x509.Certificate{caInstance.Cert}, caInstance.Chain...)
+		if err := ca.SaveCAChain(chain, caInstance.Key, certPath, keyPath, passphrase); err != nil {
+			fmt.Printf("Failed to save encrypted key: %v\n", err)
+			return
+		}
+		fmt.Printf("CA key %s is now encrypted\n", keyPath)
+	},
+}
+
+var caCertsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "Manage the persistent leaf certificate store",
+}
+
+var caCertsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List stored leaf certificates",
+	Run: func(cmd *cobra.Command, args []string) {
+		store, err := openStore(cmd)
+		if err != nil {
+			fmt.Printf("Failed to open certificate store: %v\n", err)
+			return
+		}
+
+		stored, err := store.List()
+		if err != nil {
+			fmt.Printf("Failed to list certificates: %v\n", err)
+			return
+		}
+		if len(stored) == 0 {
+			fmt.Printf("No certificates stored in %s\n", store.Dir)
+			return
+		}
+
+		for _, entry := range stored {
+			names := append([]string(nil), entry.Cert.DNSNames...)
+			for _, ip := range entry.Cert.IPAddresses {
+				names = append(names, ip.String())
+			}
+			fmt.Printf("%-40s %-32X %s (%s)\n", strings.Join(names, ","), entry.Cert.SerialNumber,
+				entry.Cert.NotAfter.Format("2006-01-02"), expiryDescription(entry.Cert.NotAfter))
+		}
+	},
+}
+
+var caCertsPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove expired stored certificates and those not issued by the current CA",
+	Run: func(cmd *cobra.Command, args []string) {
+		certPath, _ := caFilePaths(cmd)
+		all, _ := cmd.Flags().GetBool("all")
+
+		store, err := openStore(cmd)
+		if err != nil {
+			fmt.Printf("Failed to open certificate store: %v\n", err)
+			return
+		}
+
+		var issuer *x509.Certificate
+		if certs, err := ca.ReadCertificates(certPath); err == nil {
+			issuer = certs[0]
+		}
+
+		removed, err := store.Prune(issuer, all)
+		if err != nil {
+			fmt.Printf("Failed to prune certificates: %v\n", err)
+			return
+		}
+		fmt.Printf("Removed %d certificate(s) from %s\n", removed, store.Dir)
+	},
+}
+
+// openStore opens the leaf certificate store next to the selected CA
+func openStore(cmd *cobra.Command) (*ca.Store, error) {
+	certPath, _ := caFilePaths(cmd)
+	return ca.NewStore(filepath.Join(filepath.Dir(certPath), "certs"))
+}
+
+// caPaths returns the CA directory and the default CA certificate and key paths,
+// creating the directory if needed
+func caPaths() (dir, certPath, keyPath string) {
+	home, _ := os.UserHomeDir()
+	dir = filepath.Join(home, ".interceptify")
+	os.MkdirAll(dir, 0700)
+	return dir, filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+}
+
+// caFilePaths returns the CA certificate and key paths selected by the ca command flags
+func caFilePaths(cmd *cobra.Command) (certPath, keyPath string) {
+	_, certPath, keyPath = caPaths()
+	if path, _ := cmd.Flags().GetString("ca-cert"); path != "" {
+		certPath = path
+	}
+	if path, _ := cmd.Flags().GetString("ca-key"); path != "" {
+		keyPath = path
+	}
+	return certPath, keyPath
+}
+
+// sameFile reports whether a and b name the same existing file
+func sameFile(a, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// rootConfigFromFlags builds a root CA configuration from the init/rotate flags
+func rootConfigFromFlags(cmd *cobra.Command) (ca.Config, error) {
+	cfg := ca.DefaultConfig()
+
+	keyTypeName, _ := cmd.Flags().GetString("key-type")
+	keyType, err := ca.ParseKeyType(keyTypeName)
+	if err != nil {
+		return cfg, err
+	}
+	days, _ := cmd.Flags().GetInt("days")
+	if days <= 0 {
+		return cfg, fmt.Errorf("validity must be at least one day")
+	}
+
+	cfg.RootKeyType = keyType
+	cfg.CommonName, _ = cmd.Flags().GetString("cn")
+	cfg.Organization, _ = cmd.Flags().GetString("org")
+	cfg.Validity = time.Duration(days) * 24 * time.Hour
+
+	cfg.PermittedDNSDomains, _ = cmd.Flags().GetStringSlice("permit-dns")
+	permitIP, _ := cmd.Flags().GetStringSlice("permit-ip")
+	if cfg.PermittedIPRanges, err = ca.ParseIPRanges(permitIP); err != nil {
+		return cfg, err
+	}
+
+	passphraseFile, _ := cmd.Flags().GetString("ca-passphrase-file")
+	encrypt, _ := cmd.Flags().GetBool("encrypt")
+	cfg.Passphrase, err = newKeyPassphrase(passphraseFile, encrypt)
+	return cfg, err
+}
+
+// loadCA loads the CA selected by the ca command flags, resolving the key
+// passphrase if the key is encrypted
+func loadCA(cmd *cobra.Command) (*ca.CA, error) {
+	caInstance, _, err := loadCAWithPassphrase(cmd)
+	return caInstance, err
+}
+
+// loadCAWithPassphrase is loadCA, also returning the passphrase the key is
+// encrypted with (nil for an unencrypted key)
+func loadCAWithPassphrase(cmd *cobra.Command) (*ca.CA, []byte, error) {
+	certPath, keyPath := caFilePaths(cmd)
+	passphraseFile, _ := cmd.Flags().GetString("ca-passphrase-file")
+
+	passphrase, err := keyPassphrase(keyPath, passphraseFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	caInstance, err := ca.LoadCAWithPassphrase(certPath, keyPath, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if encrypted, _ := ca.IsKeyEncrypted(keyPath); !encrypted {
+		passphrase = nil
+	}
+	return caInstance, passphrase, nil
+}
+
+// generateRoot generates a root CA from cfg and saves it to the given paths
+func generateRoot(cfg ca.Config, certPath, keyPath string) (*x509.Certificate, error) {
+	cert, key, err := ca.GenerateRootCA(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.SaveCAChain([]*x509.Certificate{cert}, key, certPath, keyPath, cfg.Passphrase); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// printCertificate prints the identifying details of a certificate
+func printCertificate(cert *x509.Certificate) {
+	fmt.Printf("  Subject:     %s\n", cert.Subject)
+	fmt.Printf("  Issuer:      %s\n", cert.Issuer)
+	fmt.Printf("  Serial:      %X\n", cert.SerialNumber)
+	fmt.Printf("  Key:         %s\n", ca.KeyTypeOf(cert.PublicKey))
+	fmt.Printf("  Not Before:  %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Printf("  Not After:   %s (%s)\n", cert.NotAfter.Format(time.RFC3339), expiryDescription(cert.NotAfter))
+	fmt.Printf("  SHA-256:     %s\n", ca.Fingerprint(cert))
+	fmt.Printf("  SHA-1:       %s\n", ca.FingerprintSHA1(cert))
+	if len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 {
+		names := append([]string(nil), cert.DNSNames...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		fmt.Printf("  SANs:        %s\n", strings.Join(names, ", "))
+	}
+	if len(cert.PermittedDNSDomains) > 0 || len(cert.PermittedIPRanges) > 0 {
+		permitted := append([]string(nil), cert.PermittedDNSDomains...)
+		for _, ipNet := range cert.PermittedIPRanges {
+			permitted = append(permitted, ipNet.String())
+		}
+		fmt.Printf("  Permitted:   %s\n", strings.Join(permitted, ", "))
+	}
+}
+
+func expiryDescription(notAfter time.Time) string {
+	remaining := time.Until(notAfter)
+	if remaining < 0 {
+		return "expired"
+	}
+	return fmt.Sprintf("expires in %d days", int(remaining.Hours()/24))
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caInitCmd, caInfoCmd, caExportCmd, caRotateCmd, caSignCmd, caIntermediateCmd, caEncryptCmd, caCertsCmd)
+	caCertsCmd.AddCommand(caCertsListCmd, caCertsPruneCmd)
+
+	caCmd.PersistentFlags().String("ca-cert", "", "CA certificate path (default ~/.interceptify/ca.crt)")
+	caCmd.PersistentFlags().String("ca-key", "", "CA private key path (default ~/.interceptify/ca.key)")
+	caCmd.PersistentFlags().String("ca-passphrase-file", "", "File containing the CA key passphrase (or set "+passphraseEnv+")")
+
+	defaults := ca.DefaultConfig()
+	for _, cmd := range []*cobra.Command{caInitCmd, caRotateCmd} {
+		cmd.Flags().String("cn", defaults.CommonName, "Root CA common name")
+		cmd.Flags().String("org", defaults.Organization, "Root CA organization")
+		cmd.Flags().String("key-type", string(defaults.RootKeyType), "Root CA key type")
+		cmd.Flags().Int("days", int(defaults.Validity.Hours()/24), "Root CA validity in days")
+		cmd.Flags().StringSlice("permit-dns", nil, "Restrict the root to these DNS domains (X.509 name constraints)")
+		cmd.Flags().StringSlice("permit-ip", nil, "Restrict the root to these IP ranges in CIDR form (X.509 name constraints)")
+	}
+	for _, cmd := range []*cobra.Command{caInitCmd, caRotateCmd, caIntermediateCmd} {
+		cmd.Flags().Bool("encrypt", false, "Encrypt the new key with a passphrase (prompted if not configured)")
+	}
+	caInitCmd.Flags().Bool("force", false, "Overwrite an existing CA")
+	caIntermediateCmd.Flags().Bool("force", false, "Overwrite an existing CA (never the root itself)")
+
+	caExportCmd.Flags().String("format", "pem", "Export format: pem, der, or p12")
+	caExportCmd.Flags().StringP("out", "o", "", "Output file (default stdout)")
+	caExportCmd.Flags().Bool("include-key", false, "Include the private key in PEM or PKCS#12 output")
+	caExportCmd.Flags().Bool("no-encrypt", false, "Write an encrypted CA key unencrypted in PEM output")
+	caExportCmd.Flags().String("password", "", "PKCS#12 password (required with --include-key)")
+
+	caSignCmd.Flags().String("out-cert", "", "Where to write the certificate chain (default <host>.crt)")
+	caSignCmd.Flags().String("out-key", "", "Where to write the private key (default <host>.key)")
+	caSignCmd.Flags().String("key-type", string(ca.KeyTypeECDSAP256), "Leaf key type")
+
+	caIntermediateCmd.Flags().String("root-cert", "", "Path to the root CA certificate")
+	caIntermediateCmd.Flags().String("root-key", "", "Path to the root CA private key")
+	caIntermediateCmd.Flags().String("root-passphrase-file", "", "File containing the root CA key passphrase")
+	caIntermediateCmd.Flags().String("key-type", string(ca.KeyTypeECDSAP256), "Intermediate key type")
+	caIntermediateCmd.Flags().Int("days", 825, "Intermediate validity in days (capped at the root's expiry)")
+	caIntermediateCmd.MarkFlagRequired("root-cert")
+	caIntermediateCmd.MarkFlagRequired("root-key")
+
+	caCertsPruneCmd.Flags().Bool("all", false, "Remove every stored certificate")
+
+	caEncryptCmd.Flags().String("new-passphrase-file", "", "File containing the new passphrase (prompted if omitted)")
+}
@@ -0,0 +1,83 @@
+package interceptify
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+)
+
+// runCLI executes the interceptify command line with args
+func runCLI(t *testing.T, args ...string) {
+	t.Helper()
+	rootCmd.SetArgs(args)
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("interceptify %v failed: %v", args, err)
+	}
+}
+
+// readFiles returns the contents of paths, for checking they were left alone
+func readFiles(t *testing.T, paths ...string) []byte {
+	t.Helper()
+	var contents []byte
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		contents = append(contents, data...)
+	}
+	return contents
+}
+
+func TestCAIntermediateKeepsExistingFiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(passphraseEnv, "")
+
+	// The root is the CA the proxy created in its default location
+	dir, rootCert, rootKey := caPaths()
+	if _, err := generateRoot(ca.DefaultConfig(), rootCert, rootKey); err != nil {
+		t.Fatalf("failed to generate root CA: %v", err)
+	}
+	root := readFiles(t, rootCert, rootKey)
+
+	// Without --ca-cert/--ca-key the output paths are the root's own files,
+	// which must survive even with --force
+	for _, force := range []string{"--force=false", "--force=true"} {
+		runCLI(t, "ca", "intermediate", "--root-cert", rootCert, "--root-key", rootKey,
+			"--ca-cert", "", "--ca-key", "", force)
+		if !bytes.Equal(readFiles(t, rootCert, rootKey), root) {
+			t.Fatalf("root CA was overwritten (%s)", force)
+		}
+	}
+
+	// Other existing files are only replaced with --force
+	certPath, keyPath := filepath.Join(dir, "intermediate.crt"), filepath.Join(dir, "intermediate.key")
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.WriteFile(path, []byte("existing"), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	args := []string{"ca", "intermediate", "--root-cert", rootCert, "--root-key", rootKey,
+		"--ca-cert", certPath, "--ca-key", keyPath}
+	runCLI(t, append(args, "--force=false")...)
+	if got := readFiles(t, certPath, keyPath); string(got) != "existingexisting" {
+		t.Fatal("existing files were overwritten without --force")
+	}
+
+	runCLI(t, append(args, "--force=true")...)
+	intermediate, err := ca.LoadCAWithPassphrase(certPath, keyPath, nil)
+	if err != nil {
+		t.Fatalf("failed to load intermediate CA: %v", err)
+	}
+	rootCA, err := ca.LoadCAWithPassphrase(rootCert, rootKey, nil)
+	if err != nil {
+		t.Fatalf("failed to load root CA: %v", err)
+	}
+	if err := intermediate.Cert.CheckSignatureFrom(rootCA.Cert); err != nil {
+		t.Errorf("intermediate is not signed by the root: %v", err)
+	}
+}
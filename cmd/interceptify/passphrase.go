@@ -0,0 +1,93 @@
+package interceptify
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+	"golang.org/x/term"
+)
+
+// passphraseEnv names the environment variable holding the CA key passphrase
+const passphraseEnv = "INTERCEPTIFY_CA_PASSPHRASE"
+
+// configuredPassphrase returns the CA key passphrase from passphraseFile or,
+// failing that, the INTERCEPTIFY_CA_PASSPHRASE environment variable. It
+// returns nil if neither is set.
+func configuredPassphrase(passphraseFile string) ([]byte, error) {
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		passphrase := bytes.TrimRight(data, "\r\n")
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("passphrase file %s is empty", passphraseFile)
+		}
+		return passphrase, nil
+	}
+
+	if env := os.Getenv(passphraseEnv); env != "" {
+		return []byte(env), nil
+	}
+	return nil, nil
+}
+
+// keyPassphrase returns the passphrase needed to load the key at keyPath.
+// Unencrypted keys need none; for encrypted keys the configured passphrase
+// is used, or the user is prompted if stdin is a terminal.
+func keyPassphrase(keyPath, passphraseFile string) ([]byte, error) {
+	passphrase, err := configuredPassphrase(passphraseFile)
+	if err != nil || passphrase != nil {
+		return passphrase, err
+	}
+
+	encrypted, err := ca.IsKeyEncrypted(keyPath)
+	if err != nil || !encrypted {
+		return nil, nil
+	}
+	return promptPassphrase(fmt.Sprintf("Passphrase for %s: ", keyPath), false)
+}
+
+// newKeyPassphrase returns the passphrase used to encrypt a key about to be
+// written. When required is set and no passphrase is configured, the user is
+// prompted for one.
+func newKeyPassphrase(passphraseFile string, required bool) ([]byte, error) {
+	passphrase, err := configuredPassphrase(passphraseFile)
+	if err != nil || passphrase != nil || !required {
+		return passphrase, err
+	}
+	return promptPassphrase("New CA key passphrase: ", true)
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it
+func promptPassphrase(label string, confirm bool) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, ca.ErrPassphraseRequired
+	}
+
+	fmt.Fprint(os.Stderr, label)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, ca.ErrPassphraseRequired
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
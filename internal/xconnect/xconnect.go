@@ -0,0 +1,27 @@
+// Package xconnect enables extended CONNECT (RFC 8441) in the HTTP/2 server,
+// which WebSocket clients need to open WebSockets over h2.
+//
+// The HTTP/2 packages only read the setting from GODEBUG while initialising,
+// and it is not a //go:debug setting, so it is set here. Packages are
+// initialised in import path order once their dependencies are, and this
+// package depends on nothing but os and strings, so it always runs before
+// golang.org/x/net/http2 and net/http. Only the interceptify binary imports
+// it; programs embedding pkg/proxy set GODEBUG=http2xconnect=1 themselves.
+package xconnect
+
+import (
+	"os"
+	"strings"
+)
+
+func init() {
+	godebug := os.Getenv("GODEBUG")
+	if strings.Contains(godebug, "http2xconnect=") {
+		// Respect an explicit choice
+		return
+	}
+	if godebug != "" {
+		godebug += ","
+	}
+	os.Setenv("GODEBUG", godebug+"http2xconnect=1")
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"github.com/ismailtsdln/interceptify/cmd/interceptify"
+	// Lets h2 clients open WebSockets with extended CONNECT
+	_ "github.com/ismailtsdln/interceptify/internal/xconnect"
 )
 
 func main() {
@@ -1,56 +1,168 @@
 package ca
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
+	"log"
 	"math/big"
+	"net"
 	"os"
+	"strings"
 	"time"
 )
 
 // CA represents a Certificate Authority
 type CA struct {
 	Cert *x509.Certificate
-	Key  *rsa.PrivateKey
+	// Chain holds the certificates above Cert, up to the root, when Cert is an intermediate
+	Chain       []*x509.Certificate
+	Key         crypto.Signer
+	Cache       *CertCache
+	LeafKeyType KeyType
+	Pool        *KeyPool
+	// Store, when set, persists leaves across restarts and is consulted before signing
+	Store *Store
+}
+
+// Config controls how a CA is generated and how it mints leaf certificates
+type Config struct {
+	// Subject and validity of a newly generated root
+	CommonName   string
+	Organization string
+	Validity     time.Duration
+
+	RootKeyType KeyType
+	LeafKeyType KeyType
+	KeyPoolSize int
+	CacheSize   int
+
+	// Passphrase decrypts an existing key and, when set, encrypts a newly
+	// generated one
+	Passphrase []byte
+
+	// Name constraints baked into a newly generated root; leaves outside
+	// them are refused
+	PermittedDNSDomains []string
+	PermittedIPRanges   []*net.IPNet
+
+	// StoreDir enables the on-disk leaf store in the given directory
+	StoreDir string
+}
+
+// DefaultConfig returns the configuration used by NewCA
+func DefaultConfig() Config {
+	return Config{
+		CommonName:   "Interceptify Root CA",
+		Organization: "Interceptify Security",
+		Validity:     3650 * 24 * time.Hour, // 10 years
+		RootKeyType:  KeyTypeRSA4096,
+		LeafKeyType:  KeyTypeRSA2048,
+		CacheSize:    DefaultCacheSize,
+	}
 }
 
 // NewCA creates a new Root CA or loads an existing one
 func NewCA(caCertPath, caKeyPath string) (*CA, error) {
+	return NewCAWithConfig(caCertPath, caKeyPath, DefaultConfig())
+}
+
+// NewCAWithConfig creates a new Root CA or loads an existing one using cfg
+func NewCAWithConfig(caCertPath, caKeyPath string, cfg Config) (*CA, error) {
 	// If files exist, load them
 	if _, err := os.Stat(caCertPath); err == nil {
 		if _, err := os.Stat(caKeyPath); err == nil {
-			return LoadCA(caCertPath, caKeyPath)
+			caInstance, err := LoadCAWithPassphrase(caCertPath, caKeyPath, cfg.Passphrase)
+			if err != nil {
+				return nil, err
+			}
+			if err := caInstance.configure(cfg); err != nil {
+				return nil, err
+			}
+			return caInstance, nil
 		}
 	}
 
 	// Otherwise, generate new Root CA
-	cert, key, err := GenerateRootCA()
+	cert, key, err := GenerateRootCA(cfg)
 	if err != nil {
 		return nil, err
 	}
 
 	// Save to files
-	err = SaveCA(cert, key, caCertPath, caKeyPath)
+	err = SaveCAChain([]*x509.Certificate{cert}, key, caCertPath, caKeyPath, cfg.Passphrase)
 	if err != nil {
 		return nil, err
 	}
 
-	return &CA{Cert: cert, Key: key}, nil
+	caInstance := &CA{Cert: cert, Key: key}
+	if err := caInstance.configure(cfg); err != nil {
+		return nil, err
+	}
+	return caInstance, nil
+}
+
+// configure applies the leaf-signing settings of cfg
+func (c *CA) configure(cfg Config) error {
+	c.LeafKeyType = cfg.LeafKeyType
+	if c.LeafKeyType == "" {
+		c.LeafKeyType = KeyTypeRSA2048
+	}
+	c.Cache = NewCertCache(cfg.CacheSize)
+	if cfg.StoreDir != "" {
+		store, err := NewStore(cfg.StoreDir)
+		if err != nil {
+			return err
+		}
+		c.Store = store
+	}
+	if cfg.KeyPoolSize > 0 {
+		c.Pool = NewKeyPool(c.LeafKeyType, cfg.KeyPoolSize)
+	}
+	return nil
+}
+
+// Close releases background resources held by the CA
+func (c *CA) Close() {
+	if c.Pool != nil {
+		c.Pool.Close()
+	}
 }
 
 // GenerateRootCA generates a self-signed Root CA cert and key
-func GenerateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 4096)
+func GenerateRootCA(cfg Config) (*x509.Certificate, crypto.Signer, error) {
+	keyType := cfg.RootKeyType
+	if keyType == "" {
+		keyType = KeyTypeRSA4096
+	}
+	priv, err := GenerateKey(keyType)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	defaults := DefaultConfig()
+	validity := cfg.Validity
+	if validity <= 0 {
+		validity = defaults.Validity
+	}
+	commonName := cfg.CommonName
+	if commonName == "" {
+		commonName = defaults.CommonName
+	}
+	organization := cfg.Organization
+	if organization == "" {
+		organization = defaults.Organization
+	}
+
 	notBefore := time.Now()
-	notAfter := notBefore.Add(3650 * 24 * time.Hour) // 10 years
+	notAfter := notBefore.Add(validity)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -61,8 +173,8 @@ func GenerateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{"Interceptify Security"},
-			CommonName:   "Interceptify Root CA",
+			Organization: []string{organization},
+			CommonName:   commonName,
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
@@ -70,8 +182,9 @@ func GenerateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
+	applyNameConstraints(&template, cfg)
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
 	}
@@ -85,16 +198,25 @@ func GenerateRootCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 }
 
 // SaveCA saves the CA cert and key to files
-func SaveCA(cert *x509.Certificate, key *rsa.PrivateKey, certPath, keyPath string) error {
+func SaveCA(cert *x509.Certificate, key crypto.Signer, certPath, keyPath string) error {
+	return SaveCAChain([]*x509.Certificate{cert}, key, certPath, keyPath, nil)
+}
+
+// SaveCAChain saves a CA whose certificate file holds the signing
+// certificate followed by its issuers, and the signing key. If passphrase
+// is non-empty the key is written as encrypted PKCS#8.
+func SaveCAChain(chain []*x509.Certificate, key crypto.Signer, certPath, keyPath string, passphrase []byte) error {
 	certFile, err := os.Create(certPath)
 	if err != nil {
 		return err
 	}
 	defer certFile.Close()
 
-	err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
-	if err != nil {
-		return err
+	for _, cert := range chain {
+		err = pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		if err != nil {
+			return err
+		}
 	}
 
 	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -103,7 +225,17 @@ func SaveCA(cert *x509.Certificate, key *rsa.PrivateKey, certPath, keyPath strin
 	}
 	defer keyFile.Close()
 
-	err = pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	var keyBlock *pem.Block
+	if len(passphrase) > 0 {
+		keyBlock, err = EncryptKeyPEM(key, passphrase)
+	} else {
+		keyBlock, err = MarshalKeyPEM(key)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = pem.Encode(keyFile, keyBlock)
 	if err != nil {
 		return err
 	}
@@ -111,22 +243,43 @@ func SaveCA(cert *x509.Certificate, key *rsa.PrivateKey, certPath, keyPath strin
 	return nil
 }
 
-// LoadCA loads a CA from files
+// LoadCA loads a CA from files. The certificate file may hold an
+// intermediate followed by its issuers, in which case the chain is sent to
+// clients along with every leaf.
 func LoadCA(certPath, keyPath string) (*CA, error) {
-	certPEM, err := os.ReadFile(certPath)
+	return LoadCAWithPassphrase(certPath, keyPath, nil)
+}
+
+// LoadCAWithPassphrase loads a CA from files, decrypting the key with
+// passphrase if it is encrypted
+func LoadCAWithPassphrase(certPath, keyPath string, passphrase []byte) (*CA, error) {
+	certs, err := ReadCertificates(certPath)
 	if err != nil {
 		return nil, err
 	}
-	block, _ := pem.Decode(certPEM)
-	if block == nil {
-		return nil, fmt.Errorf("failed to decode certificate PEM")
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
+	cert := certs[0]
+
+	key, err := LoadKey(keyPath, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	if !publicKeysEqual(cert.PublicKey, key.Public()) {
+		return nil, fmt.Errorf("CA key does not match certificate %q", cert.Subject.CommonName)
+	}
 
-	keyPEM, err := os.ReadFile(keyPath)
+	return &CA{
+		Cert:        cert,
+		Chain:       certs[1:],
+		Key:         key,
+		Cache:       NewCertCache(DefaultCacheSize),
+		LeafKeyType: KeyTypeRSA2048,
+	}, nil
+}
+
+// LoadKey reads a PEM private key from path, decrypting it with passphrase
+// if it is stored as encrypted PKCS#8
+func LoadKey(path string, passphrase []byte) (crypto.Signer, error) {
+	keyPEM, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -134,23 +287,107 @@ func LoadCA(certPath, keyPath string) (*CA, error) {
 	if keyBlock == nil {
 		return nil, fmt.Errorf("failed to decode key PEM")
 	}
-	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if keyBlock.Type == "ENCRYPTED PRIVATE KEY" {
+		return DecryptKeyPEM(keyBlock, passphrase)
+	}
+	return ParseKeyPEM(keyBlock)
+}
+
+// IsKeyEncrypted reports whether the PEM key at path is passphrase-protected
+func IsKeyEncrypted(path string) (bool, error) {
+	keyPEM, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return false, fmt.Errorf("failed to decode key PEM")
+	}
+	return keyBlock.Type == "ENCRYPTED PRIVATE KEY", nil
+}
+
+// ReadCertificates reads every PEM certificate in the file at path
+func ReadCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
+	return parseCertificatesPEM(data)
+}
+
+// parseCertificatesPEM decodes every CERTIFICATE block in data
+func parseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("failed to decode certificate PEM")
+	}
+	return certs, nil
+}
 
-	return &CA{Cert: cert, Key: key}, nil
+// publicKeysEqual reports whether two public keys are identical
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
 }
 
-// SignCertificate signs a new certificate for a specific host using the Root CA
-func (c *CA) SignCertificate(host string) (*x509.Certificate, *rsa.PrivateKey, error) {
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+// IsIntermediate reports whether the CA signs with a certificate issued by another CA
+func (c *CA) IsIntermediate() bool {
+	return !isSelfSigned(c.Cert)
+}
+
+// chainDER returns the DER certificates to send after a leaf: the signing
+// certificate and its issuers when the CA is an intermediate, omitting the
+// self-signed root the client already trusts
+func (c *CA) chainDER() [][]byte {
+	if !c.IsIntermediate() {
+		return nil
+	}
+	chain := [][]byte{c.Cert.Raw}
+	for _, cert := range c.Chain {
+		if isSelfSigned(cert) {
+			continue
+		}
+		chain = append(chain, cert.Raw)
+	}
+	return chain
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// GenerateIntermediateCA generates an intermediate CA certificate and key
+// signed by parent. The intermediate may only issue leaf certificates.
+func GenerateIntermediateCA(parent *CA, cfg Config, validity time.Duration) (*x509.Certificate, crypto.Signer, error) {
+	keyType := cfg.RootKeyType
+	if keyType == "" {
+		keyType = KeyTypeRSA4096
+	}
+	priv, err := GenerateKey(keyType)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	notBefore := time.Now().Add(-1 * time.Hour)
-	notAfter := time.Now().Add(365 * 24 * time.Hour)
+	notBefore := time.Now()
+	notAfter := notBefore.Add(validity)
+	if notAfter.After(parent.Cert.NotAfter) {
+		notAfter = parent.Cert.NotAfter
+	}
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
@@ -162,17 +399,136 @@ func (c *CA) SignCertificate(host string) (*x509.Certificate, *rsa.PrivateKey, e
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"Interceptify Security"},
-			CommonName:   host,
+			CommonName:   "Interceptify Intermediate CA",
 		},
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent.Cert, priv.Public(), parent.Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+
+	return cert, priv, nil
+}
+
+// Certificate returns a TLS certificate for host, reusing a cached leaf when
+// one is available and signing a new one otherwise
+func (c *CA) Certificate(host string) (*tls.Certificate, error) {
+	return c.CertificateFor(HostSpec(host))
+}
+
+// CertificateFor returns a TLS certificate matching spec, reusing a cached
+// leaf when one is available and signing a new one otherwise
+func (c *CA) CertificateFor(spec LeafSpec) (*tls.Certificate, error) {
+	key := spec.key()
+	sign := func() (*tls.Certificate, error) {
+		if stored := c.loadStored(key); stored != nil {
+			return stored, nil
+		}
+
+		cert, priv, err := c.Sign(spec)
+		if err != nil {
+			return nil, err
+		}
+		tlsCert := &tls.Certificate{
+			Certificate: append([][]byte{cert.Raw}, c.chainDER()...),
+			PrivateKey:  priv,
+			Leaf:        cert,
+		}
+
+		if c.Store != nil {
+			if err := c.Store.Save(key, tlsCert); err != nil {
+				log.Printf("failed to persist certificate for %s: %v", cert.Subject.CommonName, err)
+			}
+		}
+		return tlsCert, nil
+	}
+
+	if c.Cache == nil {
+		return sign()
+	}
+	return c.Cache.Get(key, sign)
+}
+
+// loadStored returns a usable leaf from the on-disk store, ignoring entries
+// that are near expiry or were signed by a different CA
+func (c *CA) loadStored(key string) *tls.Certificate {
+	if c.Store == nil {
+		return nil
+	}
+
+	stored, err := c.Store.Load(key)
+	if err != nil {
+		log.Printf("failed to load stored certificate: %v", err)
+		return nil
+	}
+	if stored == nil || nearExpiry(stored) || stored.Leaf.CheckSignatureFrom(c.Cert) != nil {
+		return nil
+	}
+
+	stored.Certificate = append(stored.Certificate, c.chainDER()...)
+	return stored
+}
+
+// SignCertificate signs a new certificate for a specific host using the Root CA
+func (c *CA) SignCertificate(host string) (*x509.Certificate, crypto.Signer, error) {
+	return c.Sign(HostSpec(host))
+}
+
+// Sign signs a new leaf certificate carrying the identity described by spec
+func (c *CA) Sign(spec LeafSpec) (*x509.Certificate, crypto.Signer, error) {
+	if err := c.checkNameConstraints(spec); err != nil {
+		return nil, nil, err
+	}
+
+	priv, err := c.leafKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notBefore := spec.NotBefore
+	if notBefore.IsZero() {
+		notBefore = time.Now().Add(-1 * time.Hour)
+	}
+	notAfter := spec.NotAfter
+	if notAfter.IsZero() {
+		notAfter = time.Now().Add(365 * 24 * time.Hour)
+	}
+	// A leaf outliving its issuer is rejected by some clients
+	if notAfter.After(c.Cert.NotAfter) {
+		notAfter = c.Cert.NotAfter
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               spec.Subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsageFor(priv),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{host},
+		DNSNames:              spec.DNSNames,
+		IPAddresses:           spec.IPAddresses,
 	}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, c.Cert, &priv.PublicKey, c.Key)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, c.Cert, priv.Public(), c.Key)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to sign certificate: %v", err)
 	}
@@ -184,3 +540,35 @@ func (c *CA) SignCertificate(host string) (*x509.Certificate, *rsa.PrivateKey, e
 
 	return cert, priv, nil
 }
+
+// leafKey returns a key for a new leaf, taking it from the pool when possible
+func (c *CA) leafKey() (crypto.Signer, error) {
+	if c.Pool != nil {
+		return c.Pool.Get()
+	}
+	keyType := c.LeafKeyType
+	if keyType == "" {
+		keyType = KeyTypeRSA2048
+	}
+	return GenerateKey(keyType)
+}
+
+// Fingerprint returns the colon-separated SHA-256 fingerprint of a certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return formatFingerprint(sum[:])
+}
+
+// FingerprintSHA1 returns the colon-separated SHA-1 fingerprint of a certificate
+func FingerprintSHA1(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return formatFingerprint(sum[:])
+}
+
+func formatFingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -1,8 +1,19 @@
 package ca
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCA(t *testing.T) {
@@ -37,3 +48,359 @@ func TestCA(t *testing.T) {
 		t.Errorf("expected CommonName %s, got %s", host, cert.Subject.CommonName)
 	}
 }
+
+// newTestCA creates a CA with ECDSA P-256 keys in a temporary directory.
+// configure, when set, adjusts the configuration first.
+func newTestCA(t *testing.T, configure func(*Config)) *CA {
+	t.Helper()
+	dir := t.TempDir()
+	return newTestCAAt(t, filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), configure)
+}
+
+// newTestCAAt is newTestCA for tests that reopen the CA files
+func newTestCAAt(t *testing.T, certPath, keyPath string, configure func(*Config)) *CA {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.RootKeyType = KeyTypeECDSAP256
+	cfg.LeafKeyType = KeyTypeECDSAP256
+	if configure != nil {
+		configure(&cfg)
+	}
+	caInstance, err := NewCAWithConfig(certPath, keyPath, cfg)
+	if err != nil {
+		t.Fatalf("failed to create CA: %v", err)
+	}
+	return caInstance
+}
+
+func TestCertificateCache(t *testing.T) {
+	caInstance := newTestCA(t, nil)
+
+	// Concurrent lookups for the same host should share one signing operation
+	const workers = 20
+	certs := make(chan *tls.Certificate, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := caInstance.Certificate("example.com")
+			if err != nil {
+				t.Errorf("failed to get certificate: %v", err)
+				return
+			}
+			certs <- cert
+		}()
+	}
+	wg.Wait()
+	close(certs)
+
+	var first *tls.Certificate
+	for cert := range certs {
+		if first == nil {
+			first = cert
+		} else if cert != first {
+			t.Fatal("expected all callers to receive the same certificate")
+		}
+	}
+
+	stats := caInstance.Cache.Stats()
+	if stats.Misses != 1 || stats.Hits != workers-1 {
+		t.Errorf("expected 1 miss and %d hits, got %s", workers-1, stats)
+	}
+}
+
+func TestCertCacheEviction(t *testing.T) {
+	cache := NewCertCache(2)
+	sign := func(notAfter time.Time) func() (*tls.Certificate, error) {
+		return func() (*tls.Certificate, error) {
+			return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: notAfter}}, nil
+		}
+	}
+
+	valid := time.Now().Add(365 * 24 * time.Hour)
+	cache.Get("a", sign(valid))
+	cache.Get("b", sign(valid))
+	cache.Get("a", sign(valid))
+	cache.Get("c", sign(valid)) // evicts "b", the least recently used
+
+	if stats := cache.Stats(); stats.Size != 2 || stats.Evictions != 1 {
+		t.Errorf("expected size 2 with 1 eviction, got %s", stats)
+	}
+
+	cache.Get("b", sign(valid))
+	if stats := cache.Stats(); stats.Misses != 4 {
+		t.Errorf("expected evicted entry to miss, got %s", stats)
+	}
+
+	// Entries close to expiry are signed again
+	cache.Get("soon", sign(time.Now().Add(time.Hour)))
+	cache.Get("soon", sign(valid))
+	if stats := cache.Stats(); stats.Misses != 6 {
+		t.Errorf("expected near-expiry entry to miss, got %s", stats)
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	dir := t.TempDir()
+	caCertPath, caKeyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	newTestCAAt(t, caCertPath, caKeyPath, nil)
+
+	// Reload from disk to exercise the EC PEM round trip
+	caInstance, err := LoadCA(caCertPath, caKeyPath)
+	if err != nil {
+		t.Fatalf("failed to load ECDSA CA: %v", err)
+	}
+	if _, ok := caInstance.Key.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("expected ECDSA root key, got %T", caInstance.Key)
+	}
+
+	for _, kt := range []KeyType{KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519} {
+		caInstance.LeafKeyType = kt
+		cert, _, err := caInstance.SignCertificate("example.com")
+		if err != nil {
+			t.Fatalf("failed to sign %s leaf: %v", kt, err)
+		}
+		if err := cert.CheckSignatureFrom(caInstance.Cert); err != nil {
+			t.Errorf("%s leaf not signed by root: %v", kt, err)
+		}
+	}
+
+	pool := NewKeyPool(KeyTypeEd25519, 4)
+	defer pool.Close()
+	key, err := pool.Get()
+	if err != nil {
+		t.Fatalf("failed to get key from pool: %v", err)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Errorf("expected Ed25519 key from pool, got %T", key)
+	}
+}
+
+func TestIntermediateCA(t *testing.T) {
+	root := newTestCA(t, nil)
+
+	cert, key, err := GenerateIntermediateCA(root, Config{RootKeyType: KeyTypeECDSAP256}, 30*24*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to generate intermediate: %v", err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	if err := SaveCAChain([]*x509.Certificate{cert, root.Cert}, key, certPath, keyPath, nil); err != nil {
+		t.Fatalf("failed to save intermediate: %v", err)
+	}
+
+	intermediate, err := LoadCA(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("failed to load intermediate: %v", err)
+	}
+	if !intermediate.IsIntermediate() {
+		t.Fatal("expected loaded CA to be an intermediate")
+	}
+
+	tlsCert, err := intermediate.Certificate("example.com")
+	if err != nil {
+		t.Fatalf("failed to sign leaf: %v", err)
+	}
+	if len(tlsCert.Certificate) != 2 {
+		t.Fatalf("expected leaf + intermediate in chain, got %d certificates", len(tlsCert.Certificate))
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Cert)
+	inters := x509.NewCertPool()
+	inters.AddCert(cert)
+	_, err = tlsCert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots, Intermediates: inters})
+	if err != nil {
+		t.Errorf("leaf does not chain to root: %v", err)
+	}
+}
+
+func TestEncryptedKey(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	newTestCAAt(t, certPath, keyPath, func(cfg *Config) {
+		cfg.Passphrase = []byte("correct horse")
+	})
+
+	if encrypted, err := IsKeyEncrypted(keyPath); err != nil || !encrypted {
+		t.Fatalf("expected key to be encrypted (err: %v)", err)
+	}
+
+	// Refuse to start without a passphrase
+	if _, err := NewCAWithConfig(certPath, keyPath, DefaultConfig()); !errors.Is(err, ErrPassphraseRequired) {
+		t.Errorf("expected ErrPassphraseRequired, got %v", err)
+	}
+
+	if _, err := LoadCAWithPassphrase(certPath, keyPath, []byte("wrong")); !errors.Is(err, ErrIncorrectPassphrase) {
+		t.Errorf("expected ErrIncorrectPassphrase, got %v", err)
+	}
+
+	caInstance, err := LoadCAWithPassphrase(certPath, keyPath, []byte("correct horse"))
+	if err != nil {
+		t.Fatalf("failed to load encrypted CA: %v", err)
+	}
+	if _, _, err := caInstance.SignCertificate("example.com"); err != nil {
+		t.Errorf("failed to sign with decrypted key: %v", err)
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	caInstance := newTestCA(t, func(cfg *Config) {
+		cfg.PermittedDNSDomains = []string{"staging.example.com"}
+	})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caInstance.Cert)
+	for _, host := range []string{"staging.example.com", "api.staging.example.com"} {
+		cert, _, err := caInstance.SignCertificate(host)
+		if err != nil {
+			t.Fatalf("expected %s to be permitted: %v", host, err)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("constrained leaf for %s does not verify: %v", host, err)
+		}
+	}
+
+	for _, host := range []string{"example.com", "evil-staging.example.com", "10.0.0.1"} {
+		var constraintErr *NameConstraintError
+		if _, _, err := caInstance.SignCertificate(host); !errors.As(err, &constraintErr) {
+			t.Errorf("expected NameConstraintError for %s, got %v", host, err)
+		}
+	}
+
+	// Wildcards fall under both forms of a domain constraint
+	for _, constraint := range []string{"example.com", ".example.com"} {
+		wildcardCA := newTestCA(t, func(cfg *Config) {
+			cfg.PermittedDNSDomains = []string{constraint}
+		})
+		if _, err := wildcardCA.CertificateFor(LeafSpec{DNSNames: []string{"*.example.com"}}); err != nil {
+			t.Errorf("expected *.example.com to be permitted under %q: %v", constraint, err)
+		}
+	}
+	if _, err := caInstance.CertificateFor(LeafSpec{DNSNames: []string{"*.example.com"}}); err == nil {
+		t.Error("expected *.example.com to be refused under staging.example.com")
+	}
+
+	// A CA limited to IP ranges cannot sign host names
+	ipCA := newTestCA(t, func(cfg *Config) {
+		cfg.PermittedIPRanges = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	})
+	ipRoots := x509.NewCertPool()
+	ipRoots.AddCert(ipCA.Cert)
+	cert, _, err := ipCA.SignCertificate("10.1.2.3")
+	if err != nil {
+		t.Fatalf("expected 10.1.2.3 to be permitted: %v", err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: ipRoots}); err != nil {
+		t.Errorf("constrained leaf for 10.1.2.3 does not verify: %v", err)
+	}
+	var constraintErr *NameConstraintError
+	if _, _, err := ipCA.SignCertificate("example.com"); !errors.As(err, &constraintErr) {
+		t.Errorf("expected NameConstraintError for example.com, got %v", err)
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	withStore := func(cfg *Config) {
+		cfg.StoreDir = filepath.Join(dir, "certs")
+	}
+
+	first := newTestCAAt(t, certPath, keyPath, withStore)
+	original, err := first.Certificate("example.com")
+	if err != nil {
+		t.Fatalf("failed to sign certificate: %v", err)
+	}
+
+	// A fresh CA instance, as after a restart, reuses the stored leaf
+	second := newTestCAAt(t, certPath, keyPath, withStore)
+	reloaded, err := second.Certificate("example.com")
+	if err != nil {
+		t.Fatalf("failed to get stored certificate: %v", err)
+	}
+	if reloaded.Leaf.SerialNumber.Cmp(original.Leaf.SerialNumber) != 0 {
+		t.Errorf("expected stored serial %X, got %X", original.Leaf.SerialNumber, reloaded.Leaf.SerialNumber)
+	}
+	if !publicKeysEqual(reloaded.Leaf.PublicKey, reloaded.PrivateKey.(crypto.Signer).Public()) {
+		t.Error("stored key does not match stored certificate")
+	}
+
+	stored, err := second.Store.List()
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("expected 1 stored certificate, got %d (err: %v)", len(stored), err)
+	}
+
+	if removed, err := second.Store.Prune(second.Cert, false); err != nil || removed != 0 {
+		t.Errorf("expected nothing to prune, removed %d (err: %v)", removed, err)
+	}
+	if removed, err := second.Store.Prune(second.Cert, true); err != nil || removed != 1 {
+		t.Errorf("expected 1 certificate pruned, removed %d (err: %v)", removed, err)
+	}
+}
+
+func TestTestCertificates(t *testing.T) {
+	caInstance := newTestCA(t, nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caInstance.Cert)
+
+	for _, profile := range TestProfiles {
+		cert, err := caInstance.TestCertificate("example.com", profile)
+		if err != nil {
+			t.Fatalf("failed to sign %s test certificate: %v", profile, err)
+		}
+
+		_, verifyErr := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+		switch profile {
+		case ProfileWeakKey:
+			// Go still accepts 1024-bit RSA, so only the key size is checked
+			if got := KeyTypeOf(cert.Leaf.PublicKey); got != "rsa1024" {
+				t.Errorf("expected rsa1024 weak key, got %s", got)
+			}
+		default:
+			if verifyErr == nil {
+				t.Errorf("expected %s test certificate to fail verification", profile)
+			}
+		}
+	}
+
+	if _, err := ParseTestProfile("bogus"); err == nil {
+		t.Error("expected unknown profile to be rejected")
+	}
+}
+
+func TestMimicSpec(t *testing.T) {
+	caInstance := newTestCA(t, nil)
+
+	// An expired, CN-only upstream certificate
+	upstream := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "legacy.example.com"},
+		NotBefore: time.Now().Add(-2 * 365 * 24 * time.Hour),
+		NotAfter:  time.Now().Add(-24 * time.Hour),
+	}
+	spec := MimicSpec(upstream, "legacy.example.com")
+	if len(spec.DNSNames) != 1 || spec.DNSNames[0] != "legacy.example.com" {
+		t.Errorf("expected the requested host as the only SAN, got %v", spec.DNSNames)
+	}
+
+	cert, err := caInstance.CertificateFor(spec)
+	if err != nil {
+		t.Fatalf("failed to sign mimicked leaf: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caInstance.Cert)
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "legacy.example.com", Roots: roots}); err != nil {
+		t.Errorf("expected a currently valid leaf for the requested host: %v", err)
+	}
+
+	// A valid upstream keeps its window and gains the requested IP
+	upstream.DNSNames = []string{"legacy.example.com"}
+	upstream.NotAfter = time.Now().Add(90 * 24 * time.Hour)
+	spec = MimicSpec(upstream, "10.0.0.1")
+	if !spec.NotAfter.Equal(upstream.NotAfter) || len(spec.IPAddresses) != 1 || spec.IPAddresses[0].String() != "10.0.0.1" {
+		t.Errorf("expected upstream validity and IP SAN 10.0.0.1, got %v and %v", spec.NotAfter, spec.IPAddresses)
+	}
+}
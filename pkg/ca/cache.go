@@ -0,0 +1,155 @@
+package ca
+
+import (
+	"container/list"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of leaf certificates kept in memory by default
+const DefaultCacheSize = 1024
+
+// expiryMargin is how close to NotAfter a cached leaf may get before it is
+// evicted and signed again
+const expiryMargin = 24 * time.Hour
+
+// CacheStats is a snapshot of certificate cache activity
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+}
+
+func (s CacheStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d evictions=%d size=%d", s.Hits, s.Misses, s.Evictions, s.Size)
+}
+
+type cacheEntry struct {
+	key  string
+	cert *tls.Certificate
+}
+
+// call is a signing operation in progress that other lookups can wait on
+type call struct {
+	done chan struct{}
+	cert *tls.Certificate
+	err  error
+}
+
+// CertCache is a concurrency-safe, bounded LRU cache of leaf certificates.
+// Concurrent lookups for the same key share a single signing operation.
+type CertCache struct {
+	mu        sync.Mutex
+	capacity  int
+	ll        *list.List
+	items     map[string]*list.Element
+	calls     map[string]*call
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+// NewCertCache creates a cache holding at most capacity certificates
+func NewCertCache(capacity int) *CertCache {
+	if capacity <= 0 {
+		capacity = DefaultCacheSize
+	}
+	return &CertCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		calls:    make(map[string]*call),
+	}
+}
+
+// Get returns the certificate cached under key. On a miss, sign is called
+// once and its result is shared with every caller waiting on the same key.
+func (c *CertCache) Get(key string, sign func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		entry := el.Value.(*cacheEntry)
+		if !nearExpiry(entry.cert) {
+			c.ll.MoveToFront(el)
+			c.hits++
+			c.mu.Unlock()
+			return entry.cert, nil
+		}
+		c.removeElement(el)
+	}
+
+	if inflight, ok := c.calls[key]; ok {
+		c.hits++
+		c.mu.Unlock()
+		<-inflight.done
+		return inflight.cert, inflight.err
+	}
+
+	c.misses++
+	inflight := &call{done: make(chan struct{})}
+	c.calls[key] = inflight
+	c.mu.Unlock()
+
+	inflight.cert, inflight.err = sign()
+
+	c.mu.Lock()
+	delete(c.calls, key)
+	if inflight.err == nil {
+		c.add(key, inflight.cert)
+	}
+	c.mu.Unlock()
+	close(inflight.done)
+
+	return inflight.cert, inflight.err
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *CertCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Size:      c.ll.Len(),
+	}
+}
+
+func (c *CertCache) add(key string, cert *tls.Certificate) {
+	if el, ok := c.items[key]; ok {
+		el.Value.(*cacheEntry).cert = cert
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&cacheEntry{key: key, cert: cert})
+	for c.ll.Len() > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *CertCache) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+	c.evictions++
+}
+
+func nearExpiry(cert *tls.Certificate) bool {
+	if cert.Leaf == nil {
+		return false
+	}
+	return time.Until(cert.Leaf.NotAfter) < expiryMargin
+}
+
+// cacheKey builds an order-independent key from a set of names
+func cacheKey(names ...string) string {
+	normalized := make([]string, len(names))
+	for i, name := range names {
+		normalized[i] = strings.ToLower(name)
+	}
+	sort.Strings(normalized)
+	return strings.Join(normalized, ",")
+}
@@ -0,0 +1,131 @@
+package ca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NameConstraintError is returned when a leaf would name a host outside the
+// CA's X.509 name constraints
+type NameConstraintError struct {
+	Name   string
+	Issuer string
+}
+
+func (e *NameConstraintError) Error() string {
+	return fmt.Sprintf("%q is outside the name constraints of CA %q", e.Name, e.Issuer)
+}
+
+// applyNameConstraints adds the permitted subtrees from cfg to a CA template.
+// Whichever name type is left unconstrained is excluded entirely, so a CA
+// limited to DNS domains cannot sign IP literals and one limited to IP
+// ranges cannot sign host names.
+func applyNameConstraints(template *x509.Certificate, cfg Config) {
+	if len(cfg.PermittedDNSDomains) == 0 && len(cfg.PermittedIPRanges) == 0 {
+		return
+	}
+
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = cfg.PermittedDNSDomains
+	template.PermittedIPRanges = cfg.PermittedIPRanges
+	if len(cfg.PermittedIPRanges) == 0 {
+		template.ExcludedIPRanges = []*net.IPNet{
+			{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)},
+			{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)},
+		}
+	}
+	if len(cfg.PermittedDNSDomains) == 0 {
+		// An empty dNSName constraint matches every name (RFC 5280 4.2.1.10)
+		template.ExcludedDNSDomains = []string{""}
+	}
+}
+
+// ParseIPRanges parses CIDR strings such as "10.0.0.0/8" for use as name constraints
+func ParseIPRanges(cidrs []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", cidr, err)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// checkNameConstraints verifies every name in spec against the constraints
+// of the CA certificate and its issuers
+func (c *CA) checkNameConstraints(spec LeafSpec) error {
+	issuers := append([]*x509.Certificate{c.Cert}, c.Chain...)
+	for _, issuer := range issuers {
+		for _, name := range spec.DNSNames {
+			if !dnsPermitted(issuer, name) {
+				return &NameConstraintError{Name: name, Issuer: issuer.Subject.CommonName}
+			}
+		}
+		for _, ip := range spec.IPAddresses {
+			if !ipPermitted(issuer, ip) {
+				return &NameConstraintError{Name: ip.String(), Issuer: issuer.Subject.CommonName}
+			}
+		}
+	}
+	return nil
+}
+
+func dnsPermitted(issuer *x509.Certificate, name string) bool {
+	// Like clients, a wildcard is matched as a literal label, so
+	// "*.example.com" falls under both "example.com" and ".example.com"
+	name = strings.ToLower(name)
+	base, wildcard := strings.CutPrefix(name, "*.")
+
+	for _, excluded := range issuer.ExcludedDNSDomains {
+		if matchDomain(name, excluded) {
+			return false
+		}
+		// Refuse a wildcard that would also cover an excluded subdomain
+		if wildcard && excluded != "" && matchDomain(strings.TrimPrefix(strings.ToLower(excluded), "."), "."+base) {
+			return false
+		}
+	}
+	if len(issuer.PermittedDNSDomains) == 0 {
+		return true
+	}
+	for _, permitted := range issuer.PermittedDNSDomains {
+		if matchDomain(name, permitted) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomain applies RFC 5280 DNS constraint matching: "example.com" covers
+// the domain and its subdomains, ".example.com" only its subdomains
+func matchDomain(name, constraint string) bool {
+	constraint = strings.ToLower(constraint)
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+func ipPermitted(issuer *x509.Certificate, ip net.IP) bool {
+	for _, excluded := range issuer.ExcludedIPRanges {
+		if excluded.Contains(ip) {
+			return false
+		}
+	}
+	if len(issuer.PermittedIPRanges) == 0 {
+		return true
+	}
+	for _, permitted := range issuer.PermittedIPRanges {
+		if permitted.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,202 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyType identifies a private key algorithm and size
+type KeyType string
+
+const (
+	KeyTypeRSA2048   KeyType = "rsa2048"
+	KeyTypeRSA3072   KeyType = "rsa3072"
+	KeyTypeRSA4096   KeyType = "rsa4096"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+	KeyTypeEd25519   KeyType = "ed25519"
+)
+
+// KeyTypes lists every supported key type
+var KeyTypes = []KeyType{
+	KeyTypeRSA2048,
+	KeyTypeRSA3072,
+	KeyTypeRSA4096,
+	KeyTypeECDSAP256,
+	KeyTypeECDSAP384,
+	KeyTypeEd25519,
+}
+
+// ParseKeyType parses a key type name such as "ecdsa-p256"
+func ParseKeyType(s string) (KeyType, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for _, kt := range KeyTypes {
+		if string(kt) == name {
+			return kt, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported key type %q", s)
+}
+
+// GenerateKey generates a new private key of the given type
+func GenerateKey(kt KeyType) (crypto.Signer, error) {
+	switch kt {
+	case KeyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case KeyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", kt)
+	}
+}
+
+// keyUsageFor returns the leaf key usage appropriate for the key algorithm
+func keyUsageFor(key crypto.Signer) x509.KeyUsage {
+	if _, ok := key.Public().(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// MarshalKeyPEM encodes a private key using the conventional PEM type for its algorithm
+func MarshalKeyPEM(key crypto.Signer) (*pem.Block, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}, nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+}
+
+// ParseKeyPEM decodes a private key from any of the PEM types written by MarshalKeyPEM
+func ParseKeyPEM(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported key PEM type %q", block.Type)
+	}
+}
+
+// keyPoolWorkers is the number of goroutines refilling a KeyPool
+const keyPoolWorkers = 2
+
+// KeyPool keeps a buffer of pre-generated keys so that signing a leaf does
+// not have to wait for key generation
+type KeyPool struct {
+	keyType   KeyType
+	keys      chan crypto.Signer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewKeyPool creates a pool holding up to size keys of the given type and
+// starts filling it in the background
+func NewKeyPool(kt KeyType, size int) *KeyPool {
+	p := &KeyPool{
+		keyType: kt,
+		keys:    make(chan crypto.Signer, size),
+		done:    make(chan struct{}),
+	}
+	for i := 0; i < keyPoolWorkers; i++ {
+		go p.fill()
+	}
+	return p
+}
+
+// KeyType returns the type of keys produced by the pool
+func (p *KeyPool) KeyType() KeyType {
+	return p.keyType
+}
+
+// Get returns a pre-generated key, or generates one inline if the pool is empty
+func (p *KeyPool) Get() (crypto.Signer, error) {
+	select {
+	case key := <-p.keys:
+		return key, nil
+	default:
+		return GenerateKey(p.keyType)
+	}
+}
+
+// Close stops the background generators
+func (p *KeyPool) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+}
+
+func (p *KeyPool) fill() {
+	for {
+		key, err := GenerateKey(p.keyType)
+		if err != nil {
+			log.Printf("key pool: failed to generate %s key: %v", p.keyType, err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-p.done:
+				return
+			}
+		}
+
+		select {
+		case p.keys <- key:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// KeyTypeOf describes the algorithm and size of a public key, e.g. "ecdsa-p256"
+func KeyTypeOf(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.ReplaceAll(k.Curve.Params().Name, "-", ""))
+	case ed25519.PublicKey:
+		return string(KeyTypeEd25519)
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
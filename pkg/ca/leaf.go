@@ -0,0 +1,91 @@
+package ca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// LeafSpec describes the identity carried by a leaf certificate. Zero
+// validity times are replaced with the CA defaults when signing.
+type LeafSpec struct {
+	Subject     pkix.Name
+	DNSNames    []string
+	IPAddresses []net.IP
+	NotBefore   time.Time
+	NotAfter    time.Time
+}
+
+// HostSpec returns a spec for a certificate covering only host
+func HostSpec(host string) LeafSpec {
+	spec := LeafSpec{
+		Subject: pkix.Name{
+			Organization: []string{"Interceptify Security"},
+			CommonName:   host,
+		},
+	}
+
+	// IP literals must be carried as IP SANs; clients ignore them in DNSNames
+	if ip := net.ParseIP(host); ip != nil {
+		spec.IPAddresses = []net.IP{ip}
+	} else {
+		spec.DNSNames = []string{host}
+	}
+	return spec
+}
+
+// MimicSpec returns a spec copying the subject, SANs and validity window of
+// an upstream server certificate presented for host. host is always among
+// the SANs, and a window that is not currently valid (or about to expire) is
+// replaced with the CA defaults.
+func MimicSpec(upstream *x509.Certificate, host string) LeafSpec {
+	subject := upstream.Subject
+	subject.ExtraNames = nil
+
+	spec := LeafSpec{
+		Subject:     subject,
+		DNSNames:    append([]string(nil), upstream.DNSNames...),
+		IPAddresses: append([]net.IP(nil), upstream.IPAddresses...),
+	}
+
+	// Clients ignore the CN, so a CN-only upstream would yield a leaf
+	// without a usable name
+	if ip := net.ParseIP(host); ip != nil {
+		if !slices.ContainsFunc(spec.IPAddresses, ip.Equal) {
+			spec.IPAddresses = append(spec.IPAddresses, ip)
+		}
+	} else if !slices.ContainsFunc(spec.DNSNames, func(name string) bool { return strings.EqualFold(name, host) }) {
+		spec.DNSNames = append(spec.DNSNames, host)
+	}
+
+	// An expired window would be re-signed on every handshake
+	now := time.Now()
+	if !upstream.NotBefore.After(now) && upstream.NotAfter.Sub(now) > expiryMargin {
+		spec.NotBefore = upstream.NotBefore
+		spec.NotAfter = upstream.NotAfter
+	}
+	return spec
+}
+
+// names returns every SAN in the spec as a string
+func (s LeafSpec) names() []string {
+	names := append([]string(nil), s.DNSNames...)
+	for _, ip := range s.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// key identifies the spec in the certificate cache. The validity window is
+// included when set so that a rotated upstream certificate yields a new leaf.
+func (s LeafSpec) key() string {
+	key := cacheKey(s.names()...) + "|" + s.Subject.String()
+	if !s.NotBefore.IsZero() || !s.NotAfter.IsZero() {
+		key += fmt.Sprintf("|%d-%d", s.NotBefore.Unix(), s.NotAfter.Unix())
+	}
+	return key
+}
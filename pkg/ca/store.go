@@ -0,0 +1,184 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storeKeyHeader is the PEM header recording the cache key a leaf was stored under
+const storeKeyHeader = "Interceptify-Key"
+
+// unsafeFileChars matches characters not kept when deriving a file name from a host
+var unsafeFileChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+// Store persists signed leaf certificates and their keys on disk so the
+// same certificate is presented across proxy restarts
+type Store struct {
+	Dir string
+}
+
+// StoredCert describes a leaf certificate held in a Store
+type StoredCert struct {
+	Path string
+	Key  string
+	Cert *x509.Certificate
+}
+
+// NewStore opens (creating if needed) a certificate store in dir
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate store: %v", err)
+	}
+	return &Store{Dir: dir}, nil
+}
+
+// Load returns the certificate stored under key, or nil if there is none
+func (s *Store) Load(key string) (*tls.Certificate, error) {
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var leaf *x509.Certificate
+	var priv crypto.Signer
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			if leaf, err = x509.ParseCertificate(block.Bytes); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if priv, err = ParseKeyPEM(block); err != nil {
+			return nil, err
+		}
+	}
+	if leaf == nil || priv == nil {
+		return nil, fmt.Errorf("incomplete stored certificate %s", s.path(key))
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  priv,
+		Leaf:        leaf,
+	}, nil
+}
+
+// Save writes the leaf and private key of cert under key
+func (s *Store) Save(key string, cert *tls.Certificate) error {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("unsupported private key type %T", cert.PrivateKey)
+	}
+	keyBlock, err := MarshalKeyPEM(signer)
+	if err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:    "CERTIFICATE",
+		Headers: map[string]string{storeKeyHeader: key},
+		Bytes:   cert.Leaf.Raw,
+	})
+	data = append(data, pem.EncodeToMemory(keyBlock)...)
+
+	// Write atomically so a concurrent Load never sees a partial file
+	tmp, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+// List returns every certificate in the store, sorted by file name
+func (s *Store) List() ([]StoredCert, error) {
+	paths, err := filepath.Glob(filepath.Join(s.Dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var stored []StoredCert
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		stored = append(stored, StoredCert{Path: path, Key: block.Headers[storeKeyHeader], Cert: cert})
+	}
+	return stored, nil
+}
+
+// Prune removes stored certificates that are expired or close to expiry, or
+// that were not signed by issuer (when non-nil). If all is set, every
+// certificate is removed. It returns the number of files removed.
+func (s *Store) Prune(issuer *x509.Certificate, all bool) (int, error) {
+	stored, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range stored {
+		stale := time.Until(entry.Cert.NotAfter) < expiryMargin
+		if issuer != nil && entry.Cert.CheckSignatureFrom(issuer) != nil {
+			stale = true
+		}
+		if !all && !stale {
+			continue
+		}
+		if err := os.Remove(entry.Path); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// path maps a cache key to a file name that stays readable for a single host
+func (s *Store) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := key
+	if i := strings.IndexAny(name, ",|"); i >= 0 {
+		name = name[:i]
+	}
+	name = unsafeFileChars.ReplaceAllString(name, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return filepath.Join(s.Dir, name+"-"+hex.EncodeToString(sum[:8])+".pem")
+}
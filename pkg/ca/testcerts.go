@@ -0,0 +1,126 @@
+package ca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// TestProfile names a deliberately invalid certificate used to check
+// whether a client validates server certificates properly
+type TestProfile string
+
+const (
+	// ProfileExpired presents a leaf whose validity ended yesterday
+	ProfileExpired TestProfile = "expired"
+	// ProfileWrongHost presents a leaf for a different host name
+	ProfileWrongHost TestProfile = "wrong-host"
+	// ProfileSelfSigned presents a self-signed leaf that does not chain to the CA
+	ProfileSelfSigned TestProfile = "self-signed"
+	// ProfileWeakKey presents a leaf with a 1024-bit RSA key
+	ProfileWeakKey TestProfile = "weak-key"
+	// ProfileNoServerAuth presents a leaf whose extended key usage lacks serverAuth
+	ProfileNoServerAuth TestProfile = "no-server-auth"
+)
+
+// TestProfiles lists every certificate test profile
+var TestProfiles = []TestProfile{
+	ProfileExpired,
+	ProfileWrongHost,
+	ProfileSelfSigned,
+	ProfileWeakKey,
+	ProfileNoServerAuth,
+}
+
+// wrongHostName is the name placed in ProfileWrongHost certificates
+const wrongHostName = "wrong-host.interceptify.invalid"
+
+// ParseTestProfile parses a test profile name such as "expired"
+func ParseTestProfile(s string) (TestProfile, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	for _, profile := range TestProfiles {
+		if string(profile) == name {
+			return profile, nil
+		}
+	}
+	return "", fmt.Errorf("unknown certificate test profile %q", s)
+}
+
+// TestCertificate mints a certificate for host that is invalid in the way
+// described by profile. Test certificates are never cached or stored.
+func (c *CA) TestCertificate(host string, profile TestProfile) (*tls.Certificate, error) {
+	spec := HostSpec(host)
+
+	var priv crypto.Signer
+	var err error
+	if profile == ProfileWeakKey {
+		priv, err = rsa.GenerateKey(rand.Reader, 1024)
+	} else {
+		priv, err = c.leafKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               spec.Subject,
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              keyUsageFor(priv),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              spec.DNSNames,
+		IPAddresses:           spec.IPAddresses,
+	}
+	if template.NotAfter.After(c.Cert.NotAfter) {
+		template.NotAfter = c.Cert.NotAfter
+	}
+
+	parent, parentKey := c.Cert, crypto.Signer(c.Key)
+	switch profile {
+	case ProfileExpired:
+		template.NotBefore = time.Now().Add(-30 * 24 * time.Hour)
+		template.NotAfter = time.Now().Add(-24 * time.Hour)
+	case ProfileWrongHost:
+		template.Subject.CommonName = wrongHostName
+		template.DNSNames = []string{wrongHostName}
+		template.IPAddresses = nil
+	case ProfileSelfSigned:
+		parent, parentKey = &template, priv
+	case ProfileWeakKey:
+		// The weak key itself is the test
+	case ProfileNoServerAuth:
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	default:
+		return nil, fmt.Errorf("unknown certificate test profile %q", profile)
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, parent, priv.Public(), parentKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s test certificate: %v", profile, err)
+	}
+
+	cert, err := x509.ParseCertificate(derBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+	}
+
+	chain := [][]byte{cert.Raw}
+	if profile != ProfileSelfSigned {
+		chain = append(chain, c.chainDER()...)
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: priv, Leaf: cert}, nil
+}
@@ -0,0 +1,60 @@
+package plugins
+
+import (
+	"net/http"
+)
+
+// WebSocket frame opcodes (RFC 6455 section 5.2)
+const (
+	OpContinuation byte = 0x0
+	OpText         byte = 0x1
+	OpBinary       byte = 0x2
+	OpClose        byte = 0x8
+	OpPing         byte = 0x9
+	OpPong         byte = 0xA
+)
+
+// WebSocketMessage is a single WebSocket frame relayed by the proxy.
+// Payload is unmasked; the proxy masks frames it sends to the server.
+type WebSocketMessage struct {
+	// FromClient is true for frames travelling from the client to the server
+	FromClient bool
+	Opcode     byte
+	// Fin is false for all but the last frame of a fragmented message
+	Fin     bool
+	Payload []byte
+}
+
+// WebSocketConn is an intercepted WebSocket connection
+type WebSocketConn interface {
+	// ID identifies the connection on the dashboard
+	ID() uint64
+	// Request is the opening handshake sent by the client
+	Request() *http.Request
+	// Inject sends msg to the server if msg.FromClient is set, and to the
+	// client otherwise, without running it through the hooks
+	Inject(msg *WebSocketMessage) error
+}
+
+// WebSocketPlugin is implemented by plugins that inspect WebSocket frames.
+// It is optional; plugins without it only see the opening handshake.
+type WebSocketPlugin interface {
+	// OnWebSocketMessage is called for every frame in both directions. The
+	// returned message is forwarded, and returning nil drops the frame.
+	OnWebSocketMessage(conn WebSocketConn, msg *WebSocketMessage) *WebSocketMessage
+}
+
+// RunWebSocketHooks runs all registered OnWebSocketMessage hooks, stopping
+// when a plugin drops the frame
+func (m *Manager) RunWebSocketHooks(conn WebSocketConn, msg *WebSocketMessage) *WebSocketMessage {
+	for _, p := range m.plugins {
+		wp, ok := p.(WebSocketPlugin)
+		if !ok {
+			continue
+		}
+		if msg = wp.OnWebSocketMessage(conn, msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"log"
+	"slices"
+)
+
+// proxyProtos are the application protocols the proxy can intercept, in
+// order of preference
+var proxyProtos = []string{"h2", "http/1.1"}
+
+// mirrorALPN returns the protocols to offer a client whose ClientHello
+// advertised offered, limited to the one the upstream selects where the
+// client supports it, along with the upstream's protocol
+func (p *Proxy) mirrorALPN(authority, serverName string, offered []string) ([]string, string) {
+	var candidates []string
+	for _, proto := range proxyProtos {
+		if slices.Contains(offered, proto) {
+			candidates = append(candidates, proto)
+		}
+	}
+	if !slices.Contains(candidates, "h2") {
+		// The client will speak HTTP/1.1, which is always spoken upstream
+		return candidates, "http/1.1"
+	}
+
+	upstream := p.upstreamALPN(authority, serverName)
+	if slices.Contains(candidates, upstream) {
+		return []string{upstream}, upstream
+	}
+	// An h2-only client talking to an HTTP/1.1 server; requests are translated
+	return candidates, upstream
+}
+
+// upstreamALPN reports which protocol the upstream negotiates. HTTP/1.1 is
+// assumed when the upstream does not use ALPN or cannot be reached.
+func (p *Proxy) upstreamALPN(authority, serverName string) string {
+	probe := p.probeUpstream(authority, serverName)
+	if probe.err != nil {
+		log.Printf("failed to probe ALPN for %s, offering http/1.1: %v", authority, probe.err)
+		return "http/1.1"
+	}
+	if probe.proto == "" {
+		return "http/1.1"
+	}
+	return probe.proto
+}
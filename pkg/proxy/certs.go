@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+)
+
+// Certificate modes control how leaf certificates presented to clients are built
+const (
+	// CertModeHost mints a certificate naming only the requested host
+	CertModeHost = "host"
+	// CertModeMimic copies subject, SANs and validity from the real upstream certificate
+	CertModeMimic = "mimic"
+)
+
+// upstreamDialTimeout bounds connections made to inspect upstream servers
+const upstreamDialTimeout = 10 * time.Second
+
+// CertOverrideConfig maps a host pattern to a user-supplied certificate
+// that is presented instead of one minted by the CA
+type CertOverrideConfig struct {
+	Host  string `mapstructure:"host"`
+	Cert  string `mapstructure:"cert"`
+	Key   string `mapstructure:"key"`
+	Chain string `mapstructure:"chain"`
+}
+
+type certOverride struct {
+	pattern HostPattern
+	cert    *tls.Certificate
+}
+
+// AddCertOverride loads the certificate, key, and optional chain named by
+// cfg and presents them to clients connecting to matching hosts. Overrides
+// are consulted in the order they were added.
+func (p *Proxy) AddCertOverride(cfg CertOverrideConfig) error {
+	pattern, err := ParseHostPattern(cfg.Host)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate override for %s: %v", cfg.Host, err)
+	}
+	if cfg.Chain != "" {
+		chain, err := ca.ReadCertificates(cfg.Chain)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate chain for %s: %v", cfg.Host, err)
+		}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+	}
+
+	p.certOverrides = append(p.certOverrides, certOverride{pattern: pattern, cert: &cert})
+	return nil
+}
+
+// overrideFor returns the user-supplied certificate for host, if any
+func (p *Proxy) overrideFor(host string) *tls.Certificate {
+	for _, override := range p.certOverrides {
+		if override.pattern.Match(host) {
+			return override.cert
+		}
+	}
+	return nil
+}
+
+// certificateFor returns the certificate presented to a client that opened
+// a tunnel to authority and asked for serverName in its ClientHello
+func (p *Proxy) certificateFor(authority, serverName string) (*tls.Certificate, error) {
+	name := certName(authority, serverName)
+
+	if cert := p.overrideFor(name); cert != nil {
+		return cert, nil
+	}
+
+	if p.CertMode == CertModeMimic {
+		upstream, err := p.fetchUpstreamCertificate(authority, serverName)
+		if err != nil {
+			log.Printf("failed to fetch upstream certificate for %s, falling back to host-only: %v", authority, err)
+		} else if cert, err := p.CA.CertificateFor(ca.MimicSpec(upstream, name)); err != nil {
+			// e.g. upstream SANs outside the CA's name constraints
+			log.Printf("failed to mimic upstream certificate for %s, falling back to host-only: %v", authority, err)
+		} else {
+			return cert, nil
+		}
+	}
+
+	return p.CA.Certificate(name)
+}
+
+// certName returns the host a client expects a certificate for: the SNI
+// when present, otherwise the tunnel authority
+func certName(authority, serverName string) string {
+	if serverName != "" {
+		return serverName
+	}
+	return stripPort(authority)
+}
+
+// fetchUpstreamCertificate returns the upstream server's leaf certificate
+func (p *Proxy) fetchUpstreamCertificate(authority, serverName string) (*x509.Certificate, error) {
+	probe := p.probeUpstream(authority, serverName)
+	return probe.cert, probe.err
+}
+
+// withDefaultPort appends port to hostport if it does not already carry one
+func withDefaultPort(hostport, port string) string {
+	if _, _, err := net.SplitHostPort(hostport); err == nil {
+		return hostport
+	}
+	return net.JoinHostPort(stripPort(hostport), port)
+}
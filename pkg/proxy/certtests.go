@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+)
+
+// CertTestAll cycles a client through every test profile on successive connections
+const CertTestAll = "all"
+
+// certTestHistory bounds how many handshake results are kept for the report
+const certTestHistory = 1000
+
+// CertTestConfig presents deliberately invalid certificates to clients
+// connecting to matching hosts so their TLS validation can be checked
+type CertTestConfig struct {
+	Host    string `mapstructure:"host"`
+	Profile string `mapstructure:"profile"`
+}
+
+// certTestRotation identifies a client's position in the profiles of one
+// configured test, so a wildcard pattern rotates across all matching hosts
+type certTestRotation struct {
+	test   int
+	client string
+}
+
+type certTest struct {
+	pattern  HostPattern
+	profiles []ca.TestProfile
+}
+
+// CertTestResult records how a client reacted to a test certificate.
+// Accepted means the client completed the handshake, i.e. it failed to
+// reject the invalid certificate.
+type CertTestResult struct {
+	Time     time.Time      `json:"time"`
+	Client   string         `json:"client"`
+	Host     string         `json:"host"`
+	Profile  ca.TestProfile `json:"profile"`
+	Accepted bool           `json:"accepted"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// certTestLog keeps recent test results and the rotation state for CertTestAll
+type certTestLog struct {
+	mu      sync.Mutex
+	results []CertTestResult
+	next    map[certTestRotation]int
+}
+
+// AddCertTest presents the test profile named by cfg (or every profile in
+// turn for "all") to clients connecting to matching hosts. Test profiles
+// take precedence over certificate overrides.
+func (p *Proxy) AddCertTest(cfg CertTestConfig) error {
+	pattern, err := ParseHostPattern(cfg.Host)
+	if err != nil {
+		return err
+	}
+
+	var profiles []ca.TestProfile
+	if strings.EqualFold(strings.TrimSpace(cfg.Profile), CertTestAll) {
+		profiles = ca.TestProfiles
+	} else {
+		profile, err := ca.ParseTestProfile(cfg.Profile)
+		if err != nil {
+			return err
+		}
+		profiles = []ca.TestProfile{profile}
+	}
+
+	p.certTests = append(p.certTests, certTest{pattern: pattern, profiles: profiles})
+	return nil
+}
+
+// certTestFor picks the test profile to present to client for host, if any
+func (p *Proxy) certTestFor(client, host string) (ca.TestProfile, bool) {
+	for i, test := range p.certTests {
+		if !test.pattern.Match(host) {
+			continue
+		}
+		if len(test.profiles) == 1 {
+			return test.profiles[0], true
+		}
+
+		l := &p.certTestLog
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		// Start every rotation afresh rather than track unbounded clients
+		if l.next == nil || len(l.next) >= certTestHistory {
+			l.next = make(map[certTestRotation]int)
+		}
+		key := certTestRotation{test: i, client: client}
+		n := l.next[key]
+		l.next[key] = n + 1
+		return test.profiles[n%len(test.profiles)], true
+	}
+	return "", false
+}
+
+// recordCertTest stores the outcome of a handshake made with a test certificate
+func (p *Proxy) recordCertTest(client, host string, profile ca.TestProfile, handshakeErr error) {
+	result := CertTestResult{
+		Time:     time.Now(),
+		Client:   client,
+		Host:     host,
+		Profile:  profile,
+		Accepted: handshakeErr == nil,
+	}
+	verdict := "ACCEPTED (client did not validate)"
+	if handshakeErr != nil {
+		result.Error = handshakeErr.Error()
+		verdict = "rejected"
+	}
+
+	log.Printf("certificate test %s for %s from %s: %s", profile, host, client, verdict)
+	p.logEvent(fmt.Sprintf("CERT-TEST: %s %s %s %s", client, host, profile, verdict))
+
+	l := &p.certTestLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.results = append(l.results, result)
+	if len(l.results) > certTestHistory {
+		l.results = l.results[len(l.results)-certTestHistory:]
+	}
+}
+
+// CertTestReport returns recorded certificate test results grouped by client
+// address, oldest first
+func (p *Proxy) CertTestReport() map[string][]CertTestResult {
+	l := &p.certTestLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	report := make(map[string][]CertTestResult)
+	for _, result := range l.results {
+		report[result.Client] = append(report[result.Client], result)
+	}
+	return report
+}
+
+// clientHost returns the IP address part of a connection's remote address
+func clientHost(conn net.Conn) string {
+	return stripPort(conn.RemoteAddr().String())
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Client authentication modes for intercepted clients
+const (
+	// ClientAuthNone never asks intercepted clients for a certificate
+	ClientAuthNone = "none"
+	// ClientAuthRequest asks for a certificate but accepts clients without one
+	ClientAuthRequest = "request"
+	// ClientAuthRequire refuses clients that do not present a certificate
+	ClientAuthRequire = "require"
+)
+
+// ParseClientAuth maps a client authentication mode to the tls.Config setting.
+// Received certificates are recorded, not verified.
+func ParseClientAuth(mode string) (tls.ClientAuthType, error) {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case "", ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthRequire:
+		return tls.RequireAnyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("invalid client auth mode %q (expected %q, %q or %q)", mode, ClientAuthNone, ClientAuthRequest, ClientAuthRequire)
+	}
+}
+
+// ClientCertConfig maps a host pattern to the client certificate presented
+// when the proxy connects to matching upstream servers. Either Cert and Key
+// (PEM) or PKCS12 (with an optional Password) must be set.
+type ClientCertConfig struct {
+	Host     string `mapstructure:"host"`
+	Name     string `mapstructure:"name"`
+	Cert     string `mapstructure:"cert"`
+	Key      string `mapstructure:"key"`
+	PKCS12   string `mapstructure:"pkcs12"`
+	Password string `mapstructure:"password"`
+}
+
+// ClientCertForwardConfig chooses the certificate presented upstream on behalf
+// of an intercepted client that authenticated with a matching certificate.
+// A client matches by SHA-256 Fingerprint or by Subject common name pattern;
+// with neither set, it matches when it presented the configured certificate
+// itself. Configuring the client's own certificate and key forwards its
+// identity; any other certificate swaps it.
+type ClientCertForwardConfig struct {
+	Fingerprint string `mapstructure:"fingerprint"`
+	Subject     string `mapstructure:"subject"`
+	Name        string `mapstructure:"name"`
+	Cert        string `mapstructure:"cert"`
+	Key         string `mapstructure:"key"`
+	PKCS12      string `mapstructure:"pkcs12"`
+	Password    string `mapstructure:"password"`
+}
+
+// clientIdentity is a loaded upstream client certificate
+type clientIdentity struct {
+	pattern HostPattern
+	name    string
+	cert    *tls.Certificate
+}
+
+// clientForward is a compiled ClientCertForwardConfig
+type clientForward struct {
+	fingerprint string
+	subject     *HostPattern
+	identity    *clientIdentity
+}
+
+// loadClientCert reads a certificate and key from PEM files or a PKCS#12 bundle
+func loadClientCert(certFile, keyFile, pkcs12File, password string) (*tls.Certificate, error) {
+	switch {
+	case pkcs12File != "":
+		data, err := os.ReadFile(pkcs12File)
+		if err != nil {
+			return nil, err
+		}
+		key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return nil, err
+		}
+		cert := &tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+		for _, c := range chain {
+			cert.Certificate = append(cert.Certificate, c.Raw)
+		}
+		return cert, nil
+	case certFile != "" && keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &cert, nil
+	default:
+		return nil, fmt.Errorf("cert and key, or pkcs12, must be set")
+	}
+}
+
+// identityName returns name, or the certificate's common name when unset
+func identityName(name string, cert *tls.Certificate, fallback string) string {
+	if name != "" {
+		return name
+	}
+	if cn := cert.Leaf.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return fallback
+}
+
+// AddClientCert loads the client certificate named by cfg and presents it to
+// matching upstream servers that request one. Identities are consulted in the
+// order they were added.
+func (p *Proxy) AddClientCert(cfg ClientCertConfig) error {
+	pattern, err := ParseHostPattern(cfg.Host)
+	if err != nil {
+		return err
+	}
+
+	cert, err := loadClientCert(cfg.Cert, cfg.Key, cfg.PKCS12, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate for %s: %v", cfg.Host, err)
+	}
+
+	name := identityName(cfg.Name, cert, cfg.Host)
+	p.clientCerts = append(p.clientCerts, clientIdentity{pattern: pattern, name: name, cert: cert})
+	return nil
+}
+
+// AddClientCertForward presents the certificate named by cfg upstream for
+// intercepted clients that authenticate with a matching certificate. These
+// take precedence over host-based client certificates.
+func (p *Proxy) AddClientCertForward(cfg ClientCertForwardConfig) error {
+	cert, err := loadClientCert(cfg.Cert, cfg.Key, cfg.PKCS12, cfg.Password)
+	if err != nil {
+		return fmt.Errorf("failed to load forwarded client certificate: %v", err)
+	}
+
+	forward := clientForward{
+		fingerprint: normalizeFingerprint(cfg.Fingerprint),
+		identity:    &clientIdentity{name: identityName(cfg.Name, cert, "forwarded"), cert: cert},
+	}
+	if cfg.Fingerprint == "" && cfg.Subject == "" {
+		// Matches clients that present this very certificate
+		forward.fingerprint = normalizeFingerprint(ca.Fingerprint(cert.Leaf))
+	}
+	if cfg.Subject != "" {
+		pattern, err := ParseHostPattern(cfg.Subject)
+		if err != nil {
+			return err
+		}
+		forward.subject = &pattern
+	}
+
+	p.clientForwards = append(p.clientForwards, forward)
+	return nil
+}
+
+// forwardedIdentity returns the identity to present upstream on behalf of a
+// client that authenticated with state, if a forwarding rule matches
+func (p *Proxy) forwardedIdentity(state *tls.ConnectionState) *clientIdentity {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+	fingerprint := normalizeFingerprint(ca.Fingerprint(leaf))
+	for _, forward := range p.clientForwards {
+		if forward.fingerprint != "" && forward.fingerprint == fingerprint {
+			return forward.identity
+		}
+		if forward.subject != nil && forward.subject.Match(leaf.Subject.CommonName) {
+			return forward.identity
+		}
+	}
+	return nil
+}
+
+// clientCertFor returns the upstream client identity configured for host, if any
+func (p *Proxy) clientCertFor(host string) *clientIdentity {
+	for i := range p.clientCerts {
+		if p.clientCerts[i].pattern.Match(host) {
+			return &p.clientCerts[i]
+		}
+	}
+	return nil
+}
+
+// upstreamIdentity names the client certificate used for a request to u,
+// preferring forwarded over host-based identities
+func (p *Proxy) upstreamIdentity(u *url.URL, forwarded *clientIdentity) string {
+	if u.Scheme != "https" {
+		return ""
+	}
+	if forwarded != nil {
+		return forwarded.name
+	}
+	if identity := p.clientCertFor(u.Hostname()); identity != nil {
+		return identity.name
+	}
+	return ""
+}
+
+// upstreamClientConfig returns the TLS configuration for connecting to
+// host, presenting forwarded (when set) or the client certificate configured
+// for the host, and offering nextProtos via ALPN
+func (p *Proxy) upstreamClientConfig(host string, forwarded *clientIdentity, nextProtos []string) *tls.Config {
+	cfg := p.upstreamTLSConfig(host)
+	cfg.NextProtos = nextProtos
+
+	identity := forwarded
+	if identity == nil {
+		identity = p.clientCertFor(host)
+	}
+	if identity != nil {
+		cfg.Certificates = []tls.Certificate{*identity.cert}
+	}
+	return cfg
+}
+
+// dialUpstreamTLS connects to an upstream server using upstreamClientConfig
+func (p *Proxy) dialUpstreamTLS(ctx context.Context, network, addr string, forwarded *clientIdentity, nextProtos ...string) (net.Conn, error) {
+	cfg := p.upstreamClientConfig(stripPort(addr), forwarded, nextProtos)
+	return p.dialUpstreamTLSConfig(ctx, network, addr, cfg)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+)
+
+// flowHistory bounds how many completed flows are kept for the dashboard
+const flowHistory = 1000
+
+// Flow records one request the proxy forwarded upstream
+type Flow struct {
+	ID       uint64        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Client   string        `json:"client"`
+	Method   string        `json:"method"`
+	URL      string        `json:"url"`
+	Status   int           `json:"status,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// Proto is the protocol spoken with the client (HTTP, HTTPS or HTTPS/2)
+	Proto string `json:"proto"`
+	// UpstreamProto is the protocol of the upstream response, e.g. "HTTP/2.0"
+	UpstreamProto string `json:"upstream_proto,omitempty"`
+	// ClientChain is the certificate chain the intercepted client authenticated with
+	ClientChain []CertInfo `json:"client_chain,omitempty"`
+	// UpstreamIdentity names the client certificate offered upstream, if any
+	UpstreamIdentity string `json:"upstream_identity,omitempty"`
+}
+
+// CertInfo summarises a certificate recorded on a flow
+type CertInfo struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	SHA256  string `json:"sha256"`
+}
+
+// flowLog keeps the most recent flows
+type flowLog struct {
+	mu     sync.Mutex
+	nextID uint64
+	flows  []Flow
+}
+
+// newFlow starts the record for req, which is about to be sent upstream.
+// clientTLS is the intercepted client's connection state, if any, and
+// forwarded the identity presented upstream on its behalf.
+func (p *Proxy) newFlow(client, proto string, req *http.Request, clientTLS *tls.ConnectionState, forwarded *clientIdentity) *Flow {
+	flow := &Flow{
+		Time:             time.Now(),
+		Client:           client,
+		Proto:            proto,
+		Method:           req.Method,
+		URL:              req.URL.String(),
+		UpstreamIdentity: p.upstreamIdentity(req.URL, forwarded),
+	}
+	if clientTLS != nil {
+		for _, cert := range clientTLS.PeerCertificates {
+			flow.ClientChain = append(flow.ClientChain, CertInfo{
+				Subject: cert.Subject.String(),
+				Issuer:  cert.Issuer.String(),
+				SHA256:  ca.Fingerprint(cert),
+			})
+		}
+	}
+	return flow
+}
+
+// finishFlow completes flow with the upstream response or error and stores it
+func (p *Proxy) finishFlow(flow *Flow, resp *http.Response, err error) {
+	flow.Duration = time.Since(flow.Time)
+	if resp != nil {
+		flow.Status = resp.StatusCode
+		flow.UpstreamProto = resp.Proto
+	}
+	if err != nil {
+		flow.Error = err.Error()
+	}
+
+	l := &p.flowLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	flow.ID = l.nextID
+	l.flows = append(l.flows, *flow)
+	if len(l.flows) > flowHistory {
+		l.flows = l.flows[len(l.flows)-flowHistory:]
+	}
+}
+
+// Flows returns the most recent flows, oldest first
+func (p *Proxy) Flows() []Flow {
+	l := &p.flowLog
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Flow(nil), l.flows...)
+}
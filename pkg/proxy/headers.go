@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders are connection-specific headers that a proxy must not forward
+// (RFC 9110 section 7.6.1). Proxy-Connection is a common non-standard variant.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHop deletes hop-by-hop headers, including any named in the
+// Connection header, from h
+func removeHopByHop(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// headerHasToken reports whether any comma-separated value of header name
+// in h is token, compared case-insensitively
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeProxyResponse writes resp to an HTTP/1.x client that sent req,
+// re-framing it for the client connection. It reports whether the client
+// connection can be reused for another request.
+func writeProxyResponse(conn net.Conn, req *http.Request, resp *http.Response) bool {
+	removeHopByHop(resp.Header)
+
+	// The upstream may have answered over HTTP/2; the client speaks HTTP/1.x
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	resp.TransferEncoding = nil
+	resp.Close = req.Close
+
+	if resp.ContentLength < 0 && resp.Body != nil && resp.Body != http.NoBody {
+		if req.ProtoAtLeast(1, 1) {
+			resp.TransferEncoding = []string{"chunked"}
+		} else {
+			// HTTP/1.0 clients can only find the end of the body at EOF
+			resp.Close = true
+		}
+	}
+	if !req.ProtoAtLeast(1, 1) && !resp.Close {
+		resp.Header.Set("Connection", "keep-alive")
+	}
+
+	if err := resp.Write(conn); err != nil {
+		return false
+	}
+	return !resp.Close
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// HostPattern matches host names either by glob ("*.example.com") or, when
+// prefixed with "re:", by regular expression. Matching is case-insensitive
+// and ignores any port on the host.
+type HostPattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// ParseHostPattern compiles a glob or "re:" host pattern
+func ParseHostPattern(pattern string) (HostPattern, error) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" {
+		return HostPattern{}, fmt.Errorf("empty host pattern")
+	}
+
+	expr := ""
+	if rest, ok := strings.CutPrefix(pattern, "re:"); ok {
+		expr = "(?i)" + rest
+	} else {
+		var b strings.Builder
+		b.WriteString("(?i)^")
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return HostPattern{}, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+	}
+	return HostPattern{raw: pattern, re: re}, nil
+}
+
+// ParseHostPatterns compiles a list of host patterns
+func ParseHostPatterns(patterns []string) ([]HostPattern, error) {
+	compiled := make([]HostPattern, 0, len(patterns))
+	for _, pattern := range patterns {
+		hp, err := ParseHostPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, hp)
+	}
+	return compiled, nil
+}
+
+// Match reports whether host (with or without a port) matches the pattern
+func (hp HostPattern) Match(host string) bool {
+	if hp.re == nil || host == "" {
+		return false
+	}
+	return hp.re.MatchString(stripPort(host))
+}
+
+func (hp HostPattern) String() string {
+	return hp.raw
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Listener modes
+const (
+	// ModeRegular serves clients configured to use the proxy explicitly
+	ModeRegular = "regular"
+	// ModeTransparent serves connections redirected to the proxy by the
+	// firewall (iptables/nftables REDIRECT), recovering their original
+	// destination. It is only supported on Linux.
+	ModeTransparent = "transparent"
+	// ModeReverse serves clients of a single upstream, which is written as
+	// "reverse:" followed by the upstream URL
+	ModeReverse = "reverse"
+)
+
+// ParseMode parses a listener mode, returning the upstream URL for
+// reverse mode
+func ParseMode(mode string) (string, *url.URL, error) {
+	name, target, _ := strings.Cut(mode, ":")
+	switch name {
+	case ModeRegular, ModeTransparent:
+		if target != "" {
+			return "", nil, fmt.Errorf("mode %q does not take an upstream", name)
+		}
+		return name, nil, nil
+	case ModeReverse:
+		u, err := url.Parse(target)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid reverse proxy upstream %q: %v", target, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "", nil, fmt.Errorf("invalid reverse proxy upstream %q (expected reverse:http://host or reverse:https://host)", target)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return "", nil, fmt.Errorf("reverse proxy upstream %q must not have a query or fragment", target)
+		}
+		return name, u, nil
+	default:
+		return "", nil, fmt.Errorf("invalid mode %q (expected %q, %q or %q)", mode, ModeRegular, ModeTransparent, ModeReverse+":URL")
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h
+const ip6tSoOriginalDst = 80
+
+// originalDst returns the address a REDIRECTed connection was sent to
+// before netfilter rewrote its destination (SO_ORIGINAL_DST)
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("original destination requires a TCP connection, got %T", conn)
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// The kernel fills in a sockaddr_in, which fits in an ip_mreqn
+			mreq, err := unix.GetsockoptIPv6Mreq(int(fd), unix.IPPROTO_IP, unix.SO_ORIGINAL_DST)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			dst = decodeOriginalDst4(mreq)
+			return
+		}
+
+		// The kernel fills in a sockaddr_in6, which starts an ip6_mtuinfo
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), unix.IPPROTO_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		dst = decodeOriginalDst6(info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("failed to read original destination: %v", sockErr)
+	}
+	return dst, nil
+}
+
+// decodeOriginalDst4 reads the sockaddr_in returned in place of an ip_mreqn
+func decodeOriginalDst4(mreq *unix.IPv6Mreq) *net.TCPAddr {
+	sa := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(binary.BigEndian.Uint16(sa[2:4])),
+	}
+}
+
+// decodeOriginalDst6 reads the sockaddr_in6 at the start of an ip6_mtuinfo.
+// Its port is in network byte order, but the struct field is read natively.
+func decodeOriginalDst6(info *unix.IPv6MTUInfo) *net.TCPAddr {
+	var port [2]byte
+	binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+	return &net.TCPAddr{
+		IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+		Port: int(binary.BigEndian.Uint16(port[:])),
+	}
+}
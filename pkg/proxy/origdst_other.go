@@ -0,0 +1,13 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDst is only implemented on Linux
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent mode is only supported on Linux")
+}
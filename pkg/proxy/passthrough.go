@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+)
+
+// tlsRecordHeaderLen is the size of a TLS record header
+const tlsRecordHeaderLen = 5
+
+// tlsRecordTypeHandshake is the content type of TLS handshake records
+const tlsRecordTypeHandshake = 0x16
+
+// errHelloCaptured aborts the handshake used to parse a peeked ClientHello
+var errHelloCaptured = errors.New("client hello captured")
+
+// readOnlyConn feeds a fixed buffer to crypto/tls and discards its writes
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return len(b), nil }
+
+// peekClientHello parses the ClientHello at the head of r without consuming
+// it. It returns nil if the stream does not start with a TLS handshake
+// record or the ClientHello does not fit in a single record.
+func peekClientHello(r *bufio.Reader) *tls.ClientHelloInfo {
+	header, err := r.Peek(tlsRecordHeaderLen)
+	if err != nil || header[0] != tlsRecordTypeHandshake {
+		return nil
+	}
+	length := int(header[3])<<8 | int(header[4])
+	record, err := r.Peek(tlsRecordHeaderLen + length)
+	if err != nil {
+		return nil
+	}
+
+	var hello *tls.ClientHelloInfo
+	server := tls.Server(readOnlyConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			clone := *info
+			clone.Conn = nil
+			hello = &clone
+			return nil, errHelloCaptured
+		},
+	})
+	server.Handshake()
+	return hello
+}
+
+// passthrough reports whether TLS to host is tunnelled without interception
+func (p *Proxy) passthrough(host string) bool {
+	for _, pattern := range p.Passthrough {
+		if pattern.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePassthrough connects the client straight to authority without
+// terminating TLS. established is set when the CONNECT has already been
+// acknowledged.
+func (p *Proxy) handlePassthrough(conn net.Conn, authority, serverName string, established bool) {
+	label := authority
+	if serverName != "" && serverName != stripPort(authority) {
+		label = fmt.Sprintf("%s (SNI %s)", authority, serverName)
+	}
+	log.Printf("HTTPS Passthrough: %s", label)
+	p.relay(conn, authority, "PASSTHROUGH", label, established)
+}
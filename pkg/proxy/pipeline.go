@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// exchange describes the client side of a request entering the pipeline
+type exchange struct {
+	// client is the address of the client that sent the request
+	client string
+	// proto is how the client reached the proxy: HTTP, HTTPS or HTTPS/2
+	proto string
+	// clientTLS is the intercepted client's TLS state, if any
+	clientTLS *tls.ConnectionState
+	// upstreamProto is the ALPN protocol negotiated with the upstream; "h2"
+	// selects the HTTP/2 transport for https requests
+	upstreamProto string
+}
+
+// roundTrip runs req, whose URL must be absolute, through the request hooks,
+// forwards it upstream, and runs the response hooks. Every path (plain
+// HTTP, intercepted HTTP/1.1 and intercepted HTTP/2) goes through here so
+// that hooks, events, flows, error pages, and header handling are shared.
+// The returned response is never nil; the caller must close its body. A
+// successful WebSocket upgrade returns a 101 response whose body is the
+// upgraded upstream connection.
+func (p *Proxy) roundTrip(ex exchange, req *http.Request) *http.Response {
+	// The outgoing request is a copy: connection management is per hop, and
+	// the caller still needs the client's original framing to reply
+	out := req.Clone(req.Context())
+	out.RequestURI = ""
+	out.Close = false
+	removeHopByHop(out.Header)
+	// "TE: trailers" is the one TE value h2 allows, and gRPC requires it
+	if headerHasToken(req.Header, "Te", "trailers") {
+		out.Header.Set("Te", "trailers")
+	}
+
+	// WebSocket upgrades are negotiated end to end. Extensions are not
+	// offered, so that frames are never compressed and can be rewritten.
+	websocket := isWebSocket(req)
+	if websocket {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", "websocket")
+		out.Header.Del("Sec-WebSocket-Extensions")
+	}
+
+	out, shortCircuit := p.Plugins.RunRequestHooks(out)
+
+	log.Printf("%s Request: %s %s", ex.proto, out.Method, out.URL.String())
+	p.logEvent(fmt.Sprintf("%s: %s %s", ex.proto, out.Method, out.URL.String()))
+
+	forwarded := p.forwardedIdentity(ex.clientTLS)
+	flow := p.newFlow(ex.client, ex.proto, out, ex.clientTLS, forwarded)
+	if shortCircuit != nil {
+		if shortCircuit.Request == nil {
+			shortCircuit.Request = out
+		}
+		if shortCircuit.Body == nil {
+			shortCircuit.Body = http.NoBody
+		}
+		p.finishFlow(flow, shortCircuit, nil)
+		return shortCircuit
+	}
+
+	transports := p.transports(forwarded)
+	transport := transports.http
+	if out.URL.Scheme == "https" && ex.upstreamProto == "h2" && !websocket {
+		transport = transports.h2
+	}
+	client := &http.Client{
+		Transport: transport,
+		// Redirects are the client's to follow, not the proxy's
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(out)
+	p.finishFlow(flow, resp, err)
+	if err != nil {
+		log.Printf("failed to forward %s request: %v", ex.proto, err)
+		return upstreamErrorResponse(out, err)
+	}
+
+	resp = p.Plugins.RunResponseHooks(out, resp)
+	removeHopByHop(resp.Header)
+	return resp
+}
+
+// forward sends req through the pipeline and writes the response to an
+// HTTP/1.x client. It reports whether the client connection can be kept
+// alive.
+func (p *Proxy) forward(conn net.Conn, ex exchange, req *http.Request) bool {
+	resp := p.roundTrip(ex, req)
+	defer resp.Body.Close()
+	return writeProxyResponse(conn, req, resp)
+}
+
+// interceptedURL makes the origin-form URL of a request read from an
+// intercepted TLS connection absolute. The Host header names the origin;
+// the tunnel authority is used when it is missing. In reverse mode every
+// request goes to the reverse proxy target instead.
+func (p *Proxy) interceptedURL(req *http.Request, authority string) {
+	if p.Mode == ModeReverse {
+		p.reverseURL(req)
+		return
+	}
+	req.URL.Scheme = "https"
+	req.URL.Host = req.Host
+	if req.URL.Host == "" {
+		req.URL.Host = authority
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// PoolConfig sizes the connection pools of the shared upstream transports.
+// HTTP/2 upstreams multiplex requests over a single connection per host.
+type PoolConfig struct {
+	// MaxIdleConns limits idle HTTP/1.1 connections across all hosts (0 means no limit)
+	MaxIdleConns int `mapstructure:"max_idle_conns"`
+	// MaxIdleConnsPerHost limits idle HTTP/1.1 connections kept per host
+	MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+	// MaxConnsPerHost limits HTTP/1.1 connections per host, including active ones (0 means no limit)
+	MaxConnsPerHost int `mapstructure:"max_conns_per_host"`
+	// IdleTimeout closes connections that stay idle for longer
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+}
+
+// DefaultPoolConfig returns the pool sizes used unless configured otherwise
+func DefaultPoolConfig() PoolConfig {
+	return PoolConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 16,
+		IdleTimeout:         90 * time.Second,
+	}
+}
+
+// HostPoolStats counts upstream connection use for one host
+type HostPoolStats struct {
+	Requests int64 `json:"requests"`
+	Dials    int64 `json:"dials"`
+	Reused   int64 `json:"reused"`
+}
+
+// PoolStats is a snapshot of upstream connection pool use
+type PoolStats struct {
+	Transports int                      `json:"transports"`
+	Requests   int64                    `json:"requests"`
+	Dials      int64                    `json:"dials"`
+	Reused     int64                    `json:"reused"`
+	Hosts      map[string]HostPoolStats `json:"hosts"`
+}
+
+func (s PoolStats) String() string {
+	return fmt.Sprintf("%d requests over %d connections (%d reused)", s.Requests, s.Dials, s.Reused)
+}
+
+// poolStats tracks connection reuse of the upstream transports
+type poolStats struct {
+	mu    sync.Mutex
+	hosts map[string]*HostPoolStats
+}
+
+// gotConn records that a request to host obtained a connection
+func (s *poolStats) gotConn(host string, reused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hosts == nil {
+		s.hosts = make(map[string]*HostPoolStats)
+	}
+	stats, ok := s.hosts[host]
+	if !ok {
+		stats = &HostPoolStats{}
+		s.hosts[host] = stats
+	}
+	stats.Requests++
+	if reused {
+		stats.Reused++
+	} else {
+		stats.Dials++
+	}
+}
+
+func (s *poolStats) snapshot() PoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := PoolStats{Hosts: make(map[string]HostPoolStats, len(s.hosts))}
+	for host, stats := range s.hosts {
+		snapshot.Hosts[host] = *stats
+		snapshot.Requests += stats.Requests
+		snapshot.Dials += stats.Dials
+		snapshot.Reused += stats.Reused
+	}
+	return snapshot
+}
+
+// trackedTransport records pool statistics for each request it sends
+type trackedTransport struct {
+	rt    http.RoundTripper
+	stats *poolStats
+}
+
+func (t *trackedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.stats.gotConn(host, info.Reused)
+		},
+	}
+	return t.rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// upstreamProbeTTL is how long what a probe learned about an upstream is reused
+const upstreamProbeTTL = 10 * time.Minute
+
+// upstreamProbeFailureTTL is how long a failed probe is remembered, so an
+// unreachable upstream does not stall every handshake on a fresh dial
+const upstreamProbeFailureTTL = 30 * time.Second
+
+// upstreamProbe is the outcome of one TLS handshake with an upstream server,
+// serving both ALPN mirroring and certificate mimicking
+type upstreamProbe struct {
+	done    chan struct{}
+	proto   string
+	cert    *x509.Certificate
+	err     error
+	fetched time.Time
+}
+
+// finished reports whether the probe's handshake has completed
+func (pr *upstreamProbe) finished() bool {
+	select {
+	case <-pr.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pr *upstreamProbe) fresh() bool {
+	ttl := upstreamProbeTTL
+	if pr.err != nil {
+		ttl = upstreamProbeFailureTTL
+	}
+	return time.Since(pr.fetched) <= ttl
+}
+
+// upstreamProbeCache remembers probes by authority and SNI. Concurrent
+// lookups for the same upstream share a single handshake.
+type upstreamProbeCache struct {
+	mu     sync.Mutex
+	probes map[string]*upstreamProbe
+	swept  time.Time
+}
+
+// sweep drops finished probes that are no longer fresh, so the cache only
+// holds upstreams visited recently. It runs at most once per
+// upstreamProbeFailureTTL; c.mu must be held.
+func (c *upstreamProbeCache) sweep() {
+	if time.Since(c.swept) < upstreamProbeFailureTTL {
+		return
+	}
+	c.swept = time.Now()
+	for key, pr := range c.probes {
+		if pr.finished() && !pr.fresh() {
+			delete(c.probes, key)
+		}
+	}
+}
+
+// probeUpstream returns what a handshake with the upstream for authority and
+// serverName negotiated, performing one if nothing fresh is cached
+func (p *Proxy) probeUpstream(authority, serverName string) *upstreamProbe {
+	key := authority + "|" + serverName
+	c := &p.upstreamProbes
+
+	c.mu.Lock()
+	// An unfinished probe means another connection is already probing
+	if pr, ok := c.probes[key]; ok && (!pr.finished() || pr.fresh()) {
+		c.mu.Unlock()
+		<-pr.done
+		return pr
+	}
+	pr := &upstreamProbe{done: make(chan struct{})}
+	if c.probes == nil {
+		c.probes = make(map[string]*upstreamProbe)
+	}
+	c.sweep()
+	c.probes[key] = pr
+	c.mu.Unlock()
+
+	pr.proto, pr.cert, pr.err = p.handshakeUpstream(authority, serverName)
+	pr.fetched = time.Now()
+	close(pr.done)
+	return pr
+}
+
+// handshakeUpstream connects to the upstream and reports the protocol it
+// selected and its leaf certificate
+func (p *Proxy) handshakeUpstream(authority, serverName string) (string, *x509.Certificate, error) {
+	cfg := p.upstreamClientConfig(certName(authority, serverName), nil, proxyProtos)
+	// Only the negotiated protocol and the certificate contents are needed;
+	// trust is evaluated on the connection that carries the traffic
+	cfg.VerifyConnection = nil
+	conn, err := p.dialUpstreamTLSConfig(context.Background(), "tcp", withDefaultPort(authority, "443"), cfg)
+	if err != nil {
+		return "", nil, err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", nil, fmt.Errorf("upstream %s presented no certificate", authority)
+	}
+	return state.NegotiatedProtocol, state.PeerCertificates[0], nil
+}
@@ -2,12 +2,16 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 
@@ -22,8 +26,42 @@ type Proxy struct {
 	CA        *ca.CA
 	Plugins   *plugins.Manager
 	EventChan chan string
-	mu        sync.Mutex
-	clients   map[chan string]bool
+	// Mode selects how connections reach the proxy (ModeRegular, ModeTransparent or ModeReverse)
+	Mode string
+	// ReverseTarget is the upstream every request is sent to in ModeReverse
+	ReverseTarget *url.URL
+	// SOCKSAddr is where Start also accepts SOCKS5 clients; empty disables it
+	SOCKSAddr string
+	// SOCKSUsers maps SOCKS5 usernames to passwords; when set, clients must
+	// authenticate (RFC 1929)
+	SOCKSUsers map[string]string
+	// CertMode selects how client-facing certificates are built (CertModeHost or CertModeMimic)
+	CertMode string
+	// Passthrough lists hosts whose TLS is relayed untouched instead of decrypted
+	Passthrough []HostPattern
+	// PassthroughSNI also matches Passthrough against the ClientHello SNI
+	PassthroughSNI bool
+	// ClientAuth controls whether intercepted clients are asked for a certificate
+	ClientAuth tls.ClientAuthType
+	// Pool sizes the shared upstream connection pools; set before serving
+	Pool PoolConfig
+
+	mu              sync.Mutex
+	clients         map[chan string]bool
+	eventsOnce      sync.Once
+	upstreamProbes  upstreamProbeCache
+	certOverrides   []certOverride
+	certTests       []certTest
+	certTestLog     certTestLog
+	upstreamTLS     *upstreamTLSPolicy
+	upstreamProxies *upstreamProxyRoutes
+	parked          parkedConns
+	upstream        transportSet
+	clientCerts     []clientIdentity
+	clientForwards  []clientForward
+	poolStats       poolStats
+	flowLog         flowLog
+	webSockets      webSocketLog
 }
 
 // NewProxy creates a new Proxy instance
@@ -33,6 +71,9 @@ func NewProxy(addr string, caInstance *ca.CA) *Proxy {
 		CA:        caInstance,
 		Plugins:   plugins.NewManager(),
 		EventChan: make(chan string, 100),
+		Mode:      ModeRegular,
+		CertMode:  CertModeHost,
+		Pool:      DefaultPoolConfig(),
 		clients:   make(map[chan string]bool),
 	}
 }
@@ -43,20 +84,46 @@ func (p *Proxy) Start() error {
 	if err != nil {
 		return fmt.Errorf("failed to listen on %s: %v", p.Addr, err)
 	}
+
+	if p.SOCKSAddr != "" {
+		socksListener, err := net.Listen("tcp", p.SOCKSAddr)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to listen on %s: %v", p.SOCKSAddr, err)
+		}
+		go p.ServeSOCKS(socksListener)
+	}
+
+	return p.Serve(listener)
+}
+
+// Serve accepts proxy connections on listener until it is closed
+func (p *Proxy) Serve(listener net.Listener) error {
 	defer listener.Close()
 
-	log.Printf("Interceptify proxy listening on %s", p.Addr)
+	log.Printf("Interceptify proxy listening on %s (%s mode)", listener.Addr(), p.Mode)
 
-	go p.broadcastEvents()
+	p.startEvents()
+
+	handle := p.handleConnection
+	switch p.Mode {
+	case ModeTransparent:
+		handle = p.handleTransparent
+	case ModeReverse:
+		handle = p.handleReverse
+	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Printf("failed to accept connection: %v", err)
 			continue
 		}
 
-		go p.handleConnection(conn)
+		go handle(conn)
 	}
 }
 
@@ -65,25 +132,49 @@ func (p *Proxy) handleConnection(conn net.Conn) {
 
 	reader := bufio.NewReader(conn)
 
-	// peak at the first few bytes to decide if it's HTTP or something else
-	// or just use http.ReadRequest if we expect HTTP proxy behavior
-	req, err := http.ReadRequest(reader)
-	if err != nil {
-		if err != io.EOF {
-			log.Printf("failed to read request: %v", err)
+	// Plain HTTP connections are kept alive; pipelined requests are read
+	// from the buffer in order and answered in order
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read request: %v", err)
+			}
+			return
 		}
-		return
-	}
 
-	if req.Method == http.MethodConnect {
-		p.handleHTTPS(conn, req)
-	} else if strings.HasPrefix(req.Host, "interceptify.local") || req.Host == "interceptify" || req.Host == "localhost:8080" {
-		p.handleDashboard(conn, req)
-	} else {
-		p.handleHTTP(conn, req)
+		if req.Method == http.MethodConnect {
+			p.handleHTTPS(&bufferedConn{Conn: conn, r: reader}, req)
+			return
+		}
+		if isDashboardHost(req.Host) || req.Host == "localhost:8080" {
+			p.handleDashboard(conn, req)
+			return
+		}
+		if isWebSocket(req) {
+			p.handleWebSocket(&bufferedConn{Conn: conn, r: reader}, exchange{client: clientHost(conn), proto: "HTTP"}, req)
+			return
+		}
+		if isUpgrade(req) {
+			p.relayRequest(&bufferedConn{Conn: conn, r: reader}, withDefaultPort(req.URL.Host, "80"), req)
+			return
+		}
+
+		keepAlive := p.handleHTTP(conn, req)
+		// Drain any unread body so the next request starts at its request line
+		req.Body.Close()
+		if !keepAlive {
+			return
+		}
 	}
 }
 
+// startEvents starts delivering events to dashboard clients, once for
+// however many listeners are served
+func (p *Proxy) startEvents() {
+	p.eventsOnce.Do(func() { go p.broadcastEvents() })
+}
+
 func (p *Proxy) broadcastEvents() {
 	for event := range p.EventChan {
 		p.mu.Lock()
@@ -105,11 +196,32 @@ func (p *Proxy) logEvent(event string) {
 	}
 }
 
+// isDashboardHost reports whether host names the dashboard
+func isDashboardHost(host string) bool {
+	return strings.HasPrefix(host, "interceptify.local") || host == "interceptify"
+}
+
 func (p *Proxy) handleDashboard(conn net.Conn, req *http.Request) {
 	if req.URL.Path == "/events" {
 		p.handleSSE(conn)
 		return
 	}
+	if req.URL.Path == "/stats" {
+		p.handleStats(conn)
+		return
+	}
+	if req.URL.Path == "/cert-tests" {
+		p.handleCertTests(conn)
+		return
+	}
+	if req.URL.Path == "/flows" {
+		p.handleFlows(conn)
+		return
+	}
+	if req.URL.Path == "/websockets" {
+		p.handleWebSockets(conn)
+		return
+	}
 
 	html := `
 	<!DOCTYPE html>
@@ -242,6 +354,18 @@ func (p *Proxy) handleDashboard(conn net.Conn, req *http.Request) {
 				color: var(--primary);
 				margin-right: 10px;
 			}
+			.section-title {
+				margin: 2rem 0 1rem;
+				font-size: 1.1rem;
+				color: rgba(255, 255, 255, 0.6);
+			}
+			.ws-frame {
+				margin-top: 0.3rem;
+				font-size: 0.8rem;
+				white-space: pre-wrap;
+				word-break: break-all;
+				color: rgba(255, 255, 255, 0.7);
+			}
 			::-webkit-scrollbar {
 				width: 8px;
 			}
@@ -270,11 +394,24 @@ func (p *Proxy) handleDashboard(conn net.Conn, req *http.Request) {
 					<h3>Requests Intercepted</h3>
 					<div class="value" id="req-count">0</div>
 				</div>
+				<div class="card">
+					<h3>Certificate Cache (hits / misses)</h3>
+					<div class="value" id="cert-cache">0 / 0</div>
+				</div>
+				<div class="card">
+					<h3>Upstream Pool (dials / reused)</h3>
+					<div class="value" id="upstream-pool">0 / 0</div>
+				</div>
 			</div>
 
 			<div class="traffic-log" id="log">
 				<!-- Logs will appear here -->
 			</div>
+
+			<h3 class="section-title">WebSocket Connections</h3>
+			<div class="traffic-log" id="websockets">
+				<!-- WebSocket connections will appear here -->
+			</div>
 		</div>
 
 		<script>
@@ -296,6 +433,48 @@ func (p *Proxy) handleDashboard(conn net.Conn, req *http.Request) {
 					logEl.removeChild(logEl.lastChild);
 				}
 			};
+
+			const certCacheEl = document.getElementById('cert-cache');
+			const upstreamPoolEl = document.getElementById('upstream-pool');
+			const refreshStats = () => {
+				fetch('/stats')
+					.then((res) => res.json())
+					.then((stats) => {
+						certCacheEl.textContent = stats.cert_cache.hits + ' / ' + stats.cert_cache.misses;
+						upstreamPoolEl.textContent = stats.upstream_pool.dials + ' / ' + stats.upstream_pool.reused;
+					})
+					.catch(() => {});
+			};
+			refreshStats();
+			setInterval(refreshStats, 2000);
+
+			const wsEl = document.getElementById('websockets');
+			const refreshWebSockets = () => {
+				fetch('/websockets')
+					.then((res) => res.json())
+					.then((conns) => {
+						wsEl.replaceChildren();
+						conns.slice().reverse().forEach((ws) => {
+							const entry = document.createElement('div');
+							entry.className = 'log-entry';
+							const title = document.createElement('span');
+							title.className = 'method';
+							title.textContent = '#' + ws.id + ' ' + ws.proto + (ws.open ? ' OPEN' : ' CLOSED');
+							entry.append(title, ws.url);
+							ws.messages.slice(-20).forEach((msg) => {
+								const frame = document.createElement('div');
+								frame.className = 'ws-frame';
+								const flags = msg.dropped ? ' [dropped]' : msg.injected ? ' [injected]' : '';
+								frame.textContent = (msg.from_client ? '→ ' : '← ') + msg.opcode + ' (' + msg.length + ' bytes)' + flags + ' ' + msg.payload;
+								entry.appendChild(frame);
+							});
+							wsEl.appendChild(entry);
+						});
+					})
+					.catch(() => {});
+			};
+			refreshWebSockets();
+			setInterval(refreshWebSockets, 2000);
 		</script>
 	</body>
 	</html>
@@ -311,6 +490,73 @@ func (p *Proxy) handleDashboard(conn net.Conn, req *http.Request) {
 	resp.Write(conn)
 }
 
+// Stats is a snapshot of proxy internals exposed on the dashboard
+type Stats struct {
+	CertCache    ca.CacheStats `json:"cert_cache"`
+	UpstreamPool PoolStats     `json:"upstream_pool"`
+}
+
+// Stats returns a snapshot of proxy internals
+func (p *Proxy) Stats() Stats {
+	var stats Stats
+	if p.CA != nil && p.CA.Cache != nil {
+		stats.CertCache = p.CA.Cache.Stats()
+	}
+	stats.UpstreamPool = p.poolStats.snapshot()
+	stats.UpstreamPool.Transports = p.upstream.len()
+	return stats
+}
+
+func (p *Proxy) handleStats(conn net.Conn) {
+	body, err := json.Marshal(p.Stats())
+	if err != nil {
+		log.Printf("failed to encode stats: %v", err)
+		return
+	}
+	writeJSON(conn, body)
+}
+
+func (p *Proxy) handleCertTests(conn net.Conn) {
+	body, err := json.Marshal(p.CertTestReport())
+	if err != nil {
+		log.Printf("failed to encode certificate test report: %v", err)
+		return
+	}
+	writeJSON(conn, body)
+}
+
+func (p *Proxy) handleFlows(conn net.Conn) {
+	body, err := json.Marshal(p.Flows())
+	if err != nil {
+		log.Printf("failed to encode flows: %v", err)
+		return
+	}
+	writeJSON(conn, body)
+}
+
+func (p *Proxy) handleWebSockets(conn net.Conn) {
+	body, err := json.Marshal(p.WebSockets())
+	if err != nil {
+		log.Printf("failed to encode websocket connections: %v", err)
+		return
+	}
+	writeJSON(conn, body)
+}
+
+// writeJSON writes body to conn as a complete application/json response
+func writeJSON(conn net.Conn, body []byte) {
+	resp := http.Response{
+		StatusCode:    200,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Write(conn)
+}
+
 func (p *Proxy) handleSSE(conn net.Conn) {
 	// Upgrade connection to SSE
 	conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
@@ -338,66 +584,112 @@ func (p *Proxy) handleSSE(conn net.Conn) {
 	}
 }
 
-func (p *Proxy) handleHTTP(conn net.Conn, req *http.Request) {
-	log.Printf("HTTP Request: %s %s", req.Method, req.URL.String())
-	p.logEvent(fmt.Sprintf("HTTP: %s %s", req.Method, req.URL.String()))
-
-	// Simple transparent proxy logic or explicit proxy logic
-	// For now, just forward and log
-
-	client := &http.Client{}
-
-	// Clean up request for forwarding
-	req.RequestURI = ""
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to forward request: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	resp.Write(conn)
+// handleHTTP forwards a plain HTTP request and writes the response to the
+// client. It reports whether the client connection can be kept alive.
+func (p *Proxy) handleHTTP(conn net.Conn, req *http.Request) bool {
+	return p.forward(conn, exchange{client: clientHost(conn), proto: "HTTP"}, req)
 }
 
-func (p *Proxy) handleHTTPS(conn net.Conn, req *http.Request) {
+func (p *Proxy) handleHTTPS(conn *bufferedConn, req *http.Request) {
 	log.Printf("HTTPS Tunnel Request: %s", req.Host)
 	p.logEvent(fmt.Sprintf("CONNECT: %s", req.Host))
 
+	if p.passthrough(req.Host) {
+		p.handlePassthrough(conn, req.Host, "", false)
+		return
+	}
+
 	// Acknowledge the CONNECT request
 	conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 
-	// Strip port from host
-	host := strings.Split(req.Host, ":")[0]
+	p.handleTunnel(conn, req.Host, p.PassthroughSNI)
+}
 
-	// Sign a certificate for this host
-	cert, key, err := p.CA.SignCertificate(host)
-	if err != nil {
-		log.Printf("failed to sign certificate for %s: %v", host, err)
+// handleTunnel serves the stream a client sends through an established
+// tunnel to authority: TLS is intercepted, plaintext HTTP is handled by the
+// HTTP pipeline, and anything else is relayed. With matchSNI set, the
+// passthrough patterns are also matched against the ClientHello SNI.
+func (p *Proxy) handleTunnel(conn *bufferedConn, authority string, matchSNI bool) {
+	switch sniffProtocol(conn) {
+	case protocolHTTP:
+		log.Printf("Plaintext HTTP inside tunnel to %s", authority)
+		p.handleTunnelHTTP(conn, authority)
+		return
+	case protocolOpaque:
+		log.Printf("Non-TLS traffic inside tunnel to %s, relaying as-is", authority)
+		p.relay(conn, authority, "OPAQUE", authority, true)
 		return
 	}
 
-	tlsCert := tls.Certificate{
-		Certificate: [][]byte{cert.Raw},
-		PrivateKey:  key,
+	if matchSNI && len(p.Passthrough) > 0 {
+		if hello := peekClientHello(conn.r); hello != nil && p.passthrough(hello.ServerName) {
+			p.handlePassthrough(conn, authority, hello.ServerName, true)
+			return
+		}
 	}
 
+	// The tunnel authority is only a fallback; the ClientHello SNI names
+	// the host the client actually expects a certificate for
+	host := stripPort(authority)
+	client := clientHost(conn)
+
+	// Set when a deliberately invalid test certificate is presented
+	var testProfile ca.TestProfile
+	var testName string
+
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"h2", "http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := certName(authority, hello.ServerName)
+			if profile, ok := p.certTestFor(client, name); ok {
+				testProfile, testName = profile, name
+				cert, err := p.CA.TestCertificate(name, profile)
+				if err != nil {
+					log.Printf("failed to sign %s test certificate for %s: %v", profile, name, err)
+				}
+				return cert, err
+			}
+
+			cert, err := p.certificateFor(authority, hello.ServerName)
+			if err != nil {
+				log.Printf("failed to sign certificate for %s: %v", host, err)
+			}
+			return cert, err
+		},
+		ClientAuth: p.ClientAuth,
+	}
+
+	// Only offer the client the protocol the upstream selects, so an h2
+	// client is never paired with an HTTP/1.1-only server
+	var upstreamProto string
+	serverConfig := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := tlsConfig.Clone()
+			cfg.NextProtos, upstreamProto = p.mirrorALPN(authority, hello.ServerName, hello.SupportedProtos)
+			return cfg, nil
+		},
 	}
 
-	tlsConn := tls.Server(conn, tlsConfig)
-	if err := tlsConn.Handshake(); err != nil {
+	tlsConn := tls.Server(conn, serverConfig)
+	err := tlsConn.Handshake()
+	if testProfile != "" {
+		p.recordCertTest(client, testName, testProfile, err)
+	}
+	if err != nil {
 		log.Printf("TLS handshake failed for %s: %v", host, err)
 		return
 	}
 	defer tlsConn.Close()
 
+	clientProto := tlsConn.ConnectionState().NegotiatedProtocol
+	if clientProto == "" {
+		clientProto = "http/1.1"
+	}
+	p.logEvent(fmt.Sprintf("ALPN: %s client=%s upstream=%s", host, clientProto, upstreamProto))
+
 	// Check negotiated protocol
-	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+	if clientProto == "h2" {
 		log.Printf("HTTP/2 Negotiated for %s", host)
-		p.handleHTTPS2(tlsConn, req.Host)
+		p.handleHTTPS2(tlsConn, authority, upstreamProto)
 		return
 	}
 
@@ -412,50 +704,65 @@ func (p *Proxy) handleHTTPS(conn net.Conn, req *http.Request) {
 			break
 		}
 
-		p.handleInterceptedRequest(tlsConn, interceptedReq)
+		// Expose the client's TLS state, including any certificate it
+		// authenticated with, to plugins as on a server-side request
+		state := tlsConn.ConnectionState()
+		interceptedReq.TLS = &state
+
+		if isWebSocket(interceptedReq) {
+			p.interceptedURL(interceptedReq, authority)
+			ex := exchange{client: client, proto: "HTTPS", clientTLS: &state}
+			p.handleWebSocket(&bufferedConn{Conn: tlsConn, r: tlsReader}, ex, interceptedReq)
+			return
+		}
+
+		keepAlive := p.handleInterceptedRequest(tlsConn, authority, interceptedReq)
+		interceptedReq.Body.Close()
+		if !keepAlive {
+			return
+		}
 	}
 }
 
-func (p *Proxy) handleHTTPS2(conn net.Conn, host string) {
+// stripPort removes the port from a host:port authority, handling bracketed
+// IPv6 literals such as [::1]:443
+func stripPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	return host
+}
+
+// handleHTTPS2 serves an intercepted h2 connection. Requests are sent
+// upstream over h2 when upstreamProto is "h2" and translated to HTTP/1.1
+// otherwise.
+func (p *Proxy) handleHTTPS2(conn net.Conn, host, upstreamProto string) {
 	s2 := &http2.Server{}
 	s2.ServeConn(conn, &http2.ServeConnOpts{
 		Context: nil,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Construct the full URL for H2
-			r.URL.Scheme = "https"
-			r.URL.Host = host
-			p.handleInterceptedRequestH2(w, r)
+			p.interceptedURL(r, host)
+			p.handleInterceptedRequestH2(w, r, upstreamProto)
 		}),
 	})
 }
 
-func (p *Proxy) handleInterceptedRequestH2(w http.ResponseWriter, req *http.Request) {
-	// Run Request Hooks
-	req, shortCircuitResp := p.Plugins.RunRequestHooks(req)
-	if shortCircuitResp != nil {
-		copyResponse(w, shortCircuitResp)
-		return
+// handleInterceptedRequestH2 forwards a request from an intercepted h2
+// client and writes the response to its stream
+func (p *Proxy) handleInterceptedRequestH2(w http.ResponseWriter, req *http.Request, upstreamProto string) {
+	ex := exchange{
+		client:        stripPort(req.RemoteAddr),
+		proto:         "HTTPS/2",
+		clientTLS:     req.TLS,
+		upstreamProto: upstreamProto,
 	}
-
-	log.Printf("Intercepted HTTPS/2 Request: %s %s", req.Method, req.URL.String())
-	p.logEvent(fmt.Sprintf("HTTPS/2: %s %s", req.Method, req.URL.String()))
-
-	// Implement forwarding logic for HTTPS/2
-	req.RequestURI = ""
-	transport := &http2.Transport{}
-	client := &http.Client{Transport: transport}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("failed to forward intercepted H2 request: %v", err)
-		http.Error(w, err.Error(), http.StatusBadGateway)
+	if isWebSocketH2(req) {
+		p.handleWebSocketH2(w, req, ex)
 		return
 	}
+	resp := p.roundTrip(ex, req)
 	defer resp.Body.Close()
-
-	// Run Response Hooks
-	resp = p.Plugins.RunResponseHooks(req, resp)
-
 	copyResponse(w, resp)
 }
 
@@ -469,39 +776,10 @@ func copyResponse(w http.ResponseWriter, resp *http.Response) {
 	io.Copy(w, resp.Body)
 }
 
-func (p *Proxy) handleInterceptedRequest(conn net.Conn, req *http.Request) {
-	// Run Request Hooks
-	req, shortCircuitResp := p.Plugins.RunRequestHooks(req)
-	if shortCircuitResp != nil {
-		shortCircuitResp.Write(conn)
-		return
-	}
-
-	log.Printf("Intercepted HTTPS Request: %s %s", req.Method, req.URL.String())
-
-	// Implement forwarding logic for HTTPS
-	destURL := "https://" + req.Host + req.URL.String()
-	proxyReq, err := http.NewRequest(req.Method, destURL, req.Body)
-	if err != nil {
-		log.Printf("failed to create proxy request: %v", err)
-		return
-	}
-
-	// Copy headers
-	for k, v := range req.Header {
-		proxyReq.Header[k] = v
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		log.Printf("failed to forward intercepted request: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	// Run Response Hooks
-	resp = p.Plugins.RunResponseHooks(req, resp)
-
-	resp.Write(conn)
+// handleInterceptedRequest forwards a request read from an intercepted
+// HTTP/1.1 client and writes the response to it. It reports whether the
+// client connection can be kept alive.
+func (p *Proxy) handleInterceptedRequest(conn net.Conn, authority string, req *http.Request) bool {
+	p.interceptedURL(req, authority)
+	return p.forward(conn, exchange{client: clientHost(conn), proto: "HTTPS", clientTLS: req.TLS}, req)
 }
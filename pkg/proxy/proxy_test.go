@@ -1,16 +1,36 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	// Enables extended CONNECT, as the interceptify binary does
+	_ "github.com/ismailtsdln/interceptify/internal/xconnect"
 	"github.com/ismailtsdln/interceptify/pkg/ca"
+	"github.com/ismailtsdln/interceptify/pkg/plugins"
+	"golang.org/x/net/http2"
+	xproxy "golang.org/x/net/proxy"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 func TestProxyIntegration(t *testing.T) {
@@ -66,3 +86,1489 @@ func TestProxyIntegration(t *testing.T) {
 	// For full HTTPS test, we'd need to trust the CA in the client
 	// but we can at least check if the proxy handles CONNECT
 }
+
+// startTestProxy runs a proxy backed by a throwaway ECDSA CA on a random port
+func startTestProxy(t *testing.T) (*Proxy, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	p := newTestProxy(t, listener.Addr().String())
+	go p.Serve(listener)
+
+	return p, listener.Addr().String()
+}
+
+// newTestProxy creates a proxy with a fresh ECDSA CA without serving it
+func newTestProxy(t *testing.T, addr string) *Proxy {
+	t.Helper()
+	return newTestProxyWithCA(t, addr, nil)
+}
+
+// newTestProxyWithCA is newTestProxy with configure adjusting the CA first
+func newTestProxyWithCA(t *testing.T, addr string, configure func(*ca.Config)) *Proxy {
+	t.Helper()
+
+	dir := t.TempDir()
+	cfg := ca.DefaultConfig()
+	cfg.RootKeyType = ca.KeyTypeECDSAP256
+	cfg.LeafKeyType = ca.KeyTypeECDSAP256
+	if configure != nil {
+		configure(&cfg)
+	}
+	caInstance, err := ca.NewCAWithConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"), cfg)
+	if err != nil {
+		t.Fatalf("failed to setup CA: %v", err)
+	}
+	return NewProxy(addr, caInstance)
+}
+
+// connectTLS opens a CONNECT tunnel through the proxy and performs a TLS
+// handshake over it, trusting the proxy CA
+func connectTLS(t *testing.T, p *Proxy, proxyAddr, authority, serverName string) *tls.Conn {
+	t.Helper()
+
+	conn := dialTunnel(t, proxyAddr, authority)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	tlsConn := tls.Client(conn, &tls.Config{
+		RootCAs:    roots,
+		ServerName: serverName,
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake through proxy failed: %v", err)
+	}
+	return tlsConn
+}
+
+// dialTunnel opens a CONNECT tunnel to authority through the proxy
+func dialTunnel(t *testing.T, proxyAddr, authority string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", authority, authority)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected CONNECT to succeed, got %s", resp.Status)
+	}
+	return conn
+}
+
+func TestHTTPSCertificateNames(t *testing.T) {
+	p, proxyAddr := startTestProxy(t)
+
+	// SNI takes precedence over the CONNECT authority
+	state := connectTLS(t, p, proxyAddr, "203.0.113.10:443", "sni.example.com").ConnectionState()
+	leaf := state.PeerCertificates[0]
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "sni.example.com" {
+		t.Errorf("expected certificate for SNI name, got DNSNames %v", leaf.DNSNames)
+	}
+
+	// Without SNI, IP authorities (including bracketed IPv6) become IP SANs
+	for _, tc := range []struct{ authority, ip string }{
+		{"127.0.0.1:443", "127.0.0.1"},
+		{"[::1]:443", "::1"},
+	} {
+		state := connectTLS(t, p, proxyAddr, tc.authority, tc.ip).ConnectionState()
+		leaf := state.PeerCertificates[0]
+		if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP(tc.ip)) {
+			t.Errorf("%s: expected IP SAN %s, got DNSNames %v IPAddresses %v", tc.authority, tc.ip, leaf.DNSNames, leaf.IPAddresses)
+		}
+	}
+}
+
+func TestHTTPSCertificateMimic(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	upstream := backend.Certificate()
+
+	p, proxyAddr := startTestProxy(t)
+	p.CertMode = CertModeMimic
+
+	authority := backend.Listener.Addr().String()
+	state := connectTLS(t, p, proxyAddr, authority, "example.com").ConnectionState()
+	leaf := state.PeerCertificates[0]
+
+	if fmt.Sprint(leaf.DNSNames) != fmt.Sprint(upstream.DNSNames) {
+		t.Errorf("expected DNSNames %v, got %v", upstream.DNSNames, leaf.DNSNames)
+	}
+	if fmt.Sprint(leaf.IPAddresses) != fmt.Sprint(upstream.IPAddresses) {
+		t.Errorf("expected IPAddresses %v, got %v", upstream.IPAddresses, leaf.IPAddresses)
+	}
+	// Validity is copied, but never beyond the issuing CA's expiry
+	expectedNotAfter := upstream.NotAfter
+	if expectedNotAfter.After(p.CA.Cert.NotAfter) {
+		expectedNotAfter = p.CA.Cert.NotAfter
+	}
+	if !leaf.NotBefore.Equal(upstream.NotBefore) || !leaf.NotAfter.Equal(expectedNotAfter) {
+		t.Errorf("expected validity %v - %v, got %v - %v", upstream.NotBefore, expectedNotAfter, leaf.NotBefore, leaf.NotAfter)
+	}
+	if err := leaf.CheckSignatureFrom(p.CA.Cert); err != nil {
+		t.Errorf("mimicked leaf not signed by proxy CA: %v", err)
+	}
+}
+
+func TestHTTPSCertificateMimicFallback(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	// The upstream certificate carries IP SANs the constrained CA may not sign
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := newTestProxyWithCA(t, listener.Addr().String(), func(cfg *ca.Config) {
+		cfg.PermittedDNSDomains = []string{"example.com"}
+	})
+	p.CertMode = CertModeMimic
+	go p.Serve(listener)
+
+	state := connectTLS(t, p, listener.Addr().String(), backend.Listener.Addr().String(), "example.com").ConnectionState()
+	leaf := state.PeerCertificates[0]
+	if fmt.Sprint(leaf.DNSNames) != "[example.com]" || len(leaf.IPAddresses) != 0 {
+		t.Errorf("expected host-only fallback leaf, got DNSNames %v IPAddresses %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+}
+
+func TestHTTPSCertificateOverride(t *testing.T) {
+	p, proxyAddr := startTestProxy(t)
+
+	// Sign the "real" certificate with the same CA, bypassing its cache, so
+	// the client trusts it but it differs from what the proxy would mint
+	dir := t.TempDir()
+	realCert, realKey, err := p.CA.SignCertificate("api.example.com")
+	if err != nil {
+		t.Fatalf("failed to sign override certificate: %v", err)
+	}
+	keyBlock, _ := ca.MarshalKeyPEM(realKey)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: realCert.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600)
+
+	err = p.AddCertOverride(CertOverrideConfig{Host: "*.example.com", Cert: certFile, Key: keyFile})
+	if err != nil {
+		t.Fatalf("failed to add override: %v", err)
+	}
+
+	state := connectTLS(t, p, proxyAddr, "api.example.com:443", "api.example.com").ConnectionState()
+	if state.PeerCertificates[0].SerialNumber.Cmp(realCert.SerialNumber) != 0 {
+		t.Errorf("expected override certificate for matching host, got %v", state.PeerCertificates[0].DNSNames)
+	}
+}
+
+func TestHTTPSCertificateTestProfiles(t *testing.T) {
+	p, proxyAddr := startTestProxy(t)
+	if err := p.AddCertTest(CertTestConfig{Host: "expired.example.com", Profile: "expired"}); err != nil {
+		t.Fatalf("failed to add test profile: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+
+	// A validating client must refuse the expired certificate
+	strict := tls.Client(dialTunnel(t, proxyAddr, "expired.example.com:443"), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "expired.example.com",
+	})
+	if err := strict.Handshake(); err == nil {
+		t.Fatal("expected validating client to reject expired certificate")
+	}
+
+	// A client that skips validation completes the handshake
+	lax := tls.Client(dialTunnel(t, proxyAddr, "expired.example.com:443"), &tls.Config{
+		ServerName:         "expired.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err := lax.Handshake(); err != nil {
+		t.Fatalf("expected non-validating client to complete handshake: %v", err)
+	}
+	lax.Close()
+
+	var results []CertTestResult
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		results = p.CertTestReport()["127.0.0.1"]
+		if len(results) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 recorded results, got %d", len(results))
+	}
+
+	accepted := map[bool]int{}
+	for _, result := range results {
+		if result.Profile != ca.ProfileExpired || result.Host != "expired.example.com" {
+			t.Errorf("unexpected result %+v", result)
+		}
+		accepted[result.Accepted]++
+	}
+	if accepted[true] != 1 || accepted[false] != 1 {
+		t.Errorf("expected one accepted and one rejected handshake, got %v", accepted)
+	}
+}
+
+func TestHTTPSPassthrough(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "direct")
+	}))
+	defer upstream.Close()
+	upstreamAddr := upstream.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	p.Passthrough, _ = ParseHostPatterns([]string{"127.0.0.1", "pinned.example.com"})
+	p.PassthroughSNI = true
+
+	for _, serverName := range []string{"127.0.0.1", "pinned.example.com"} {
+		conn := dialTunnel(t, proxyAddr, upstreamAddr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("handshake via passthrough failed: %v", err)
+		}
+		if !tlsConn.ConnectionState().PeerCertificates[0].Equal(upstream.Certificate()) {
+			t.Errorf("expected the upstream's own certificate for SNI %s", serverName)
+		}
+		tlsConn.Close()
+	}
+
+	// Hosts not on the list are still intercepted
+	p.Passthrough, _ = ParseHostPatterns([]string{"pinned.example.com"})
+	state := connectTLS(t, p, proxyAddr, upstreamAddr, "other.example.com").ConnectionState()
+	if state.PeerCertificates[0].Equal(upstream.Certificate()) {
+		t.Error("expected non-matching host to be intercepted")
+	}
+}
+
+func TestTunnelFallbacks(t *testing.T) {
+	_, proxyAddr := startTestProxy(t)
+
+	// Plaintext HTTP inside a tunnel is served by the HTTP pipeline
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "plain %s", r.URL.Path)
+	}))
+	defer web.Close()
+
+	conn := dialTunnel(t, proxyAddr, web.Listener.Addr().String())
+	fmt.Fprintf(conn, "GET /hello HTTP/1.1\r\nHost: %s\r\n\r\n", web.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("failed to read tunnelled HTTP response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "plain /hello" {
+		t.Errorf("unexpected tunnelled HTTP body %q", body)
+	}
+
+	// Anything else is relayed byte for byte
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	conn = dialTunnel(t, proxyAddr, echo.Addr().String())
+	fmt.Fprint(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "SSH-2.0-OpenSSH_9.6\r\n" {
+		t.Errorf("expected opaque bytes echoed through tunnel, got %q (err: %v)", line, err)
+	}
+}
+
+// getThroughProxy sends a GET for authority over an intercepted TLS tunnel
+func getThroughProxy(t *testing.T, p *Proxy, proxyAddr, authority string) (*http.Response, string) {
+	t.Helper()
+
+	tlsConn := connectTLS(t, p, proxyAddr, authority, stripPort(authority))
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", authority)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("failed to read intercepted response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestUpstreamTLSPolicy(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream ok")
+	}))
+	defer upstream.Close()
+	authority := upstream.Listener.Addr().String()
+
+	// The test server's CA is not trusted by default
+	p, proxyAddr := startTestProxy(t)
+	resp, body := getThroughProxy(t, p, proxyAddr, authority)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502 for untrusted upstream, got %s", resp.Status)
+	}
+	if !strings.Contains(body, "Presented certificate chain") || !strings.Contains(body, ca.Fingerprint(upstream.Certificate())) {
+		t.Errorf("expected 502 page to describe the upstream chain, got %q", body)
+	}
+
+	// Trusting it as an extra root lets the request through
+	rootFile := filepath.Join(t.TempDir(), "root.pem")
+	os.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw}), 0600)
+
+	p, proxyAddr = startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{RootCAs: []string{rootFile}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	if resp, body := getThroughProxy(t, p, proxyAddr, authority); resp.StatusCode != http.StatusOK || body != "upstream ok" {
+		t.Errorf("expected trusted upstream to succeed, got %s %q", resp.Status, body)
+	}
+
+	// A pin that does not match is refused even for an insecure host
+	p, proxyAddr = startTestProxy(t)
+	err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{
+		Insecure: []string{"127.0.0.1"},
+		Pins:     []UpstreamPinConfig{{Host: "127.0.0.1", SHA256: []string{strings.Repeat("00", 32)}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	if resp, _ := getThroughProxy(t, p, proxyAddr, authority); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected 502 for pin mismatch, got %s", resp.Status)
+	}
+}
+
+func TestUpstreamClientCertificate(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	authority := upstream.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+
+	dir := t.TempDir()
+	clientCert, clientKey, err := p.CA.SignCertificate("mtls-client")
+	if err != nil {
+		t.Fatalf("failed to sign client certificate: %v", err)
+	}
+	p12, err := pkcs12.Modern.Encode(clientKey, clientCert, nil, "secret")
+	if err != nil {
+		t.Fatalf("failed to encode PKCS#12: %v", err)
+	}
+	p12File := filepath.Join(dir, "client.p12")
+	os.WriteFile(p12File, p12, 0600)
+
+	err = p.AddClientCert(ClientCertConfig{Host: "127.0.0.1", Name: "test-bot", PKCS12: p12File, Password: "secret"})
+	if err != nil {
+		t.Fatalf("failed to add client certificate: %v", err)
+	}
+
+	resp, body := getThroughProxy(t, p, proxyAddr, authority)
+	if resp.StatusCode != http.StatusOK || body != "hello mtls-client" {
+		t.Fatalf("expected upstream to see the client certificate, got %s %q", resp.Status, body)
+	}
+
+	flows := p.Flows()
+	if len(flows) != 1 || flows[0].UpstreamIdentity != "test-bot" {
+		t.Errorf("expected flow to record identity test-bot, got %+v", flows)
+	}
+}
+
+// clientCertPlugin records the client certificate subject seen by plugins
+type clientCertPlugin struct {
+	plugins.BasePlugin
+	seen chan string
+}
+
+func (c *clientCertPlugin) OnRequest(req *http.Request) (*http.Request, *http.Response) {
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		c.seen <- req.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	return req, nil
+}
+
+func TestInterceptedClientCertificate(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %s", r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	authority := upstream.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	p.ClientAuth = tls.RequestClientCert
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	plugin := &clientCertPlugin{seen: make(chan string, 1)}
+	p.Plugins.Register(plugin)
+
+	// Clients presenting the device certificate are swapped for the lab identity
+	dir := t.TempDir()
+	labCert, labKey, err := p.CA.SignCertificate("lab-identity")
+	if err != nil {
+		t.Fatalf("failed to sign lab certificate: %v", err)
+	}
+	keyBlock, _ := ca.MarshalKeyPEM(labKey)
+	certFile, keyFile := filepath.Join(dir, "lab.crt"), filepath.Join(dir, "lab.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: labCert.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600)
+	if err := p.AddClientCertForward(ClientCertForwardConfig{Subject: "device-*", Cert: certFile, Key: keyFile}); err != nil {
+		t.Fatalf("failed to add forwarding rule: %v", err)
+	}
+
+	device, err := p.CA.Certificate("device-42")
+	if err != nil {
+		t.Fatalf("failed to sign device certificate: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "127.0.0.1",
+		NextProtos:   []string{"http/1.1"},
+		Certificates: []tls.Certificate{*device},
+	})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", authority)
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		t.Fatalf("failed to read intercepted response: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hello lab-identity" {
+		t.Errorf("expected upstream to see the swapped identity, got %q", body)
+	}
+
+	select {
+	case cn := <-plugin.seen:
+		if cn != "device-42" {
+			t.Errorf("expected plugin to see device-42, got %s", cn)
+		}
+	default:
+		t.Error("expected plugin to see the client certificate")
+	}
+
+	flows := p.Flows()
+	if len(flows) != 1 || len(flows[0].ClientChain) == 0 || flows[0].UpstreamIdentity != "lab-identity" {
+		t.Fatalf("expected flow with client chain and lab identity, got %+v", flows)
+	}
+	if flows[0].ClientChain[0].SHA256 != ca.Fingerprint(device.Leaf) {
+		t.Errorf("expected flow to record the device certificate")
+	}
+}
+
+func TestALPNMirroring(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "served over %s", r.Proto)
+	})
+	h1 := httptest.NewTLSServer(handler)
+	defer h1.Close()
+	h2 := httptest.NewUnstartedServer(handler)
+	h2.EnableHTTP2 = true
+	h2.StartTLS()
+	defer h2.Close()
+
+	p, proxyAddr := startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+
+	tests := []struct {
+		name          string
+		upstream      *httptest.Server
+		offered       []string
+		wantClient    string
+		wantUpstream  string
+		wantServedVia string
+	}{
+		{"h1 upstream", h1, []string{"h2", "http/1.1"}, "http/1.1", "HTTP/1.1", "served over HTTP/1.1"},
+		{"h2 upstream", h2, []string{"h2", "http/1.1"}, "h2", "HTTP/2.0", "served over HTTP/2.0"},
+		{"h2-only client", h1, []string{"h2"}, "h2", "HTTP/1.1", "served over HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authority := tt.upstream.Listener.Addr().String()
+			tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+				RootCAs:    roots,
+				ServerName: "127.0.0.1",
+				NextProtos: tt.offered,
+			})
+			if err := tlsConn.Handshake(); err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if got := tlsConn.ConnectionState().NegotiatedProtocol; got != tt.wantClient {
+				t.Fatalf("expected client to negotiate %s, got %q", tt.wantClient, got)
+			}
+
+			var client *http.Client
+			if tt.wantClient == "h2" {
+				cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+				if err != nil {
+					t.Fatalf("failed to start h2 client: %v", err)
+				}
+				client = &http.Client{Transport: cc}
+			} else {
+				client = &http.Client{Transport: &http.Transport{
+					DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return tlsConn, nil },
+				}}
+			}
+			resp, err := client.Get("https://" + authority + "/")
+			if err != nil {
+				t.Fatalf("request through proxy failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != tt.wantServedVia {
+				t.Errorf("expected %q, got %q", tt.wantServedVia, body)
+			}
+
+			flows := p.Flows()
+			if got := flows[len(flows)-1].UpstreamProto; got != tt.wantUpstream {
+				t.Errorf("expected flow upstream protocol %s, got %s", tt.wantUpstream, got)
+			}
+		})
+	}
+}
+
+func TestHTTP2TETrailers(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "te=%q", r.Header.Get("Te"))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	p, proxyAddr := startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+
+	authority := backend.Listener.Addr().String()
+	tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+		RootCAs:    roots,
+		ServerName: "127.0.0.1",
+		NextProtos: []string{"h2"},
+	})
+	cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+	if err != nil {
+		t.Fatalf("failed to start h2 client: %v", err)
+	}
+
+	// gRPC clients send "TE: trailers" and servers reject calls without it
+	req, _ := http.NewRequest(http.MethodGet, "https://"+authority+"/", nil)
+	req.Header.Set("Te", "trailers")
+	resp, err := cc.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Proto != "HTTP/2.0" || string(body) != `te="trailers"` {
+		t.Errorf("expected TE: trailers upstream over h2, got %s %s", resp.Proto, body)
+	}
+	if got := p.Flows()[len(p.Flows())-1].UpstreamProto; got != "HTTP/2.0" {
+		t.Errorf("expected the request to reach the upstream over h2, got %s", got)
+	}
+}
+
+func TestUpstreamProbeShared(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	counter := &countingListener{Listener: backend.Listener}
+	backend.Listener = counter
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	p, proxyAddr := startTestProxy(t)
+	p.CertMode = CertModeMimic
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+
+	// ALPN mirroring and certificate mimicking share one upstream handshake,
+	// which later tunnels to the same upstream reuse
+	authority := backend.Listener.Addr().String()
+	for range 2 {
+		tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+			RootCAs:    roots,
+			ServerName: "example.com",
+			NextProtos: []string{"h2", "http/1.1"},
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if got := tlsConn.ConnectionState().NegotiatedProtocol; got != "h2" {
+			t.Errorf("expected h2 to be mirrored, got %q", got)
+		}
+	}
+	if got := counter.accepted.Load(); got != 1 {
+		t.Errorf("expected 1 upstream probe, got %d", got)
+	}
+}
+
+func TestUpstreamProbeExpiry(t *testing.T) {
+	p := newTestProxy(t, "127.0.0.1:0")
+
+	stale := &upstreamProbe{done: make(chan struct{}), proto: "h2", fetched: time.Now().Add(-2 * upstreamProbeTTL)}
+	close(stale.done)
+	pending := &upstreamProbe{done: make(chan struct{})}
+	p.upstreamProbes.probes = map[string]*upstreamProbe{
+		"stale.example:443|":   stale,
+		"pending.example:443|": pending,
+	}
+
+	// Probing a new upstream drops expired probes but keeps ones in flight
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closed.Close()
+	if probe := p.probeUpstream(closed.Addr().String(), ""); probe.err == nil {
+		t.Error("expected probing a closed port to fail")
+	}
+
+	probes := p.upstreamProbes.probes
+	if _, ok := probes["stale.example:443|"]; ok {
+		t.Error("expected the expired probe to be removed")
+	}
+	if _, ok := probes["pending.example:443|"]; !ok {
+		t.Error("expected the in-flight probe to be kept")
+	}
+	if _, ok := probes[closed.Addr().String()+"|"]; !ok {
+		t.Error("expected the failed probe to be cached")
+	}
+}
+
+func TestUpstreamPoolReuse(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "pooled")
+	}))
+	defer upstream.Close()
+	authority := upstream.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+
+	// Separate client connections share one upstream connection
+	for i := 0; i < 3; i++ {
+		if resp, body := getThroughProxy(t, p, proxyAddr, authority); resp.StatusCode != http.StatusOK || body != "pooled" {
+			t.Fatalf("request %d failed: %s %q", i, resp.Status, body)
+		}
+	}
+
+	stats := p.Stats().UpstreamPool.Hosts[authority]
+	if stats.Requests != 3 || stats.Dials != 1 || stats.Reused != 2 {
+		t.Errorf("expected 3 requests over 1 connection, got %+v", stats)
+	}
+}
+
+func TestHTTPKeepAlive(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Hop") != "" || r.Header.Get("Proxy-Connection") != "" {
+			http.Error(w, "hop-by-hop header forwarded", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Keep-Alive", "timeout=5")
+		// Flushing before writing leaves the length unknown, forcing chunked framing
+		w.(http.Flusher).Flush()
+		fmt.Fprintf(w, "path %s", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	_, proxyAddr := startTestProxy(t)
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	// Two pipelined requests followed by one asking to close
+	base := upstream.URL
+	fmt.Fprintf(conn, "GET %s/one HTTP/1.1\r\nHost: %s\r\nProxy-Connection: keep-alive\r\nConnection: X-Hop\r\nX-Hop: secret\r\n\r\n", base, upstream.Listener.Addr())
+	fmt.Fprintf(conn, "GET %s/two HTTP/1.1\r\nHost: %s\r\n\r\n", base, upstream.Listener.Addr())
+	fmt.Fprintf(conn, "GET %s/three HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", base, upstream.Listener.Addr())
+
+	reader := bufio.NewReader(conn)
+	for _, path := range []string{"/one", "/two", "/three"} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("failed to read response for %s: %v", path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "path "+path {
+			t.Errorf("unexpected response for %s: %s %q", path, resp.Status, body)
+		}
+		if resp.Header.Get("Keep-Alive") != "" {
+			t.Errorf("expected hop-by-hop Keep-Alive header to be removed for %s", path)
+		}
+		if path != "/three" && resp.Close {
+			t.Errorf("expected connection to stay open after %s", path)
+		}
+		if path == "/three" && !resp.Close {
+			t.Error("expected Connection: close to be honoured")
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("expected proxy to close the connection, got %v", err)
+	}
+}
+
+// markerPlugin tags requests and responses so tests can tell the hooks ran
+type markerPlugin struct {
+	plugins.BasePlugin
+}
+
+func (m *markerPlugin) OnRequest(req *http.Request) (*http.Request, *http.Response) {
+	req.Header.Set("X-Intercepted", "request")
+	return req, nil
+}
+
+func (m *markerPlugin) OnResponse(req *http.Request, resp *http.Response) *http.Response {
+	resp.Header.Set("X-Intercepted", "response")
+	return resp
+}
+
+func TestPipelineParity(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Saw", r.Header.Get("X-Intercepted"))
+		w.Header().Set("Keep-Alive", "timeout=5")
+		http.Redirect(w, r, "/elsewhere", http.StatusFound)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	defer secure.Close()
+	authority := secure.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	p.Plugins.Register(&markerPlugin{})
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	tunnel := func(protos ...string) *tls.Conn {
+		tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+			RootCAs:    roots,
+			ServerName: "127.0.0.1",
+			NextProtos: protos,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		return tlsConn
+	}
+
+	tests := []struct {
+		proto     string
+		url       string
+		transport func() http.RoundTripper
+	}{
+		{"HTTP", plain.URL + "/start", func() http.RoundTripper {
+			return &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+		}},
+		{"HTTPS", "https://" + authority + "/start", func() http.RoundTripper {
+			tlsConn := tunnel("http/1.1")
+			return &http.Transport{
+				DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) { return tlsConn, nil },
+			}
+		}},
+		{"HTTPS/2", "https://" + authority + "/start", func() http.RoundTripper {
+			cc, err := (&http2.Transport{}).NewClientConn(tunnel("h2", "http/1.1"))
+			if err != nil {
+				t.Fatalf("failed to start h2 client: %v", err)
+			}
+			return cc
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			// Subscribe like a dashboard client
+			events := make(chan string, 16)
+			p.mu.Lock()
+			p.clients[events] = true
+			p.mu.Unlock()
+			defer func() {
+				p.mu.Lock()
+				delete(p.clients, events)
+				p.mu.Unlock()
+			}()
+
+			client := &http.Client{
+				Transport: tt.transport(),
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("request through proxy failed: %v", err)
+			}
+			resp.Body.Close()
+
+			// Redirects are relayed, not followed by the proxy
+			if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/elsewhere" {
+				t.Errorf("expected redirect to be relayed, got %s to %q", resp.Status, resp.Header.Get("Location"))
+			}
+			if got := resp.Header.Get("X-Saw"); got != "request" {
+				t.Errorf("expected request hook to reach upstream, got %q", got)
+			}
+			if got := resp.Header.Get("X-Intercepted"); got != "response" {
+				t.Errorf("expected response hook to run, got %q", got)
+			}
+			if resp.Header.Get("Keep-Alive") != "" {
+				t.Error("expected hop-by-hop Keep-Alive header to be removed")
+			}
+
+			flows := p.Flows()
+			flow := flows[len(flows)-1]
+			if flow.Proto != tt.proto || flow.Status != http.StatusFound {
+				t.Errorf("expected %s flow with status 302, got %s %d", tt.proto, flow.Proto, flow.Status)
+			}
+
+			want := fmt.Sprintf("%s: GET %s", tt.proto, tt.url)
+			for found := false; !found; {
+				select {
+				case event := <-events:
+					found = event == want
+				case <-time.After(2 * time.Second):
+					t.Fatalf("expected event %q", want)
+				}
+			}
+		})
+	}
+}
+
+// webSocketEcho accepts a WebSocket handshake and echoes every frame back
+func webSocketEcho(w http.ResponseWriter, r *http.Request) {
+	if !isWebSocket(r) || r.Header.Get("Sec-WebSocket-Extensions") != "" {
+		http.Error(w, "expected a WebSocket handshake without extensions", http.StatusBadRequest)
+		return
+	}
+	accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(accept[:]))
+	rw.Flush()
+	for {
+		msg, err := readWebSocketFrame(rw)
+		if err != nil {
+			return
+		}
+		writeWebSocketFrame(conn, msg, false)
+		if msg.Opcode == plugins.OpClose {
+			return
+		}
+	}
+}
+
+// webSocketPlugin upper-cases text from the client, drops "drop", and
+// answers "inject" itself
+type webSocketPlugin struct {
+	plugins.BasePlugin
+}
+
+func (w *webSocketPlugin) OnWebSocketMessage(conn plugins.WebSocketConn, msg *plugins.WebSocketMessage) *plugins.WebSocketMessage {
+	if !msg.FromClient || msg.Opcode != plugins.OpText {
+		return msg
+	}
+	switch string(msg.Payload) {
+	case "drop":
+		return nil
+	case "inject":
+		conn.Inject(&plugins.WebSocketMessage{Opcode: plugins.OpText, Fin: true, Payload: []byte("injected")})
+		return nil
+	}
+	msg.Payload = bytes.ToUpper(msg.Payload)
+	return msg
+}
+
+// exchangeWebSocketFrames sends client frames through an intercepted
+// WebSocket and checks what the plugin and echo server send back
+func exchangeWebSocketFrames(t *testing.T, r io.Reader, w io.Writer) {
+	t.Helper()
+
+	send := func(payload string) {
+		msg := &plugins.WebSocketMessage{Opcode: plugins.OpText, Fin: true, Payload: []byte(payload)}
+		if err := writeWebSocketFrame(w, msg, true); err != nil {
+			t.Fatalf("failed to send %q: %v", payload, err)
+		}
+	}
+	expect := func(opcode byte, payload string) {
+		msg, err := readWebSocketFrame(r)
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if msg.Opcode != opcode || string(msg.Payload) != payload {
+			t.Fatalf("expected opcode %d %q, got %d %q", opcode, payload, msg.Opcode, msg.Payload)
+		}
+	}
+
+	send("hello")
+	expect(plugins.OpText, "HELLO")
+	send("drop")
+	send("after")
+	expect(plugins.OpText, "AFTER")
+	send("inject")
+	expect(plugins.OpText, "injected")
+
+	closeMsg := &plugins.WebSocketMessage{Opcode: plugins.OpClose, Fin: true, Payload: []byte{0x03, 0xe8}}
+	if err := writeWebSocketFrame(w, closeMsg, true); err != nil {
+		t.Fatalf("failed to send close frame: %v", err)
+	}
+	expect(plugins.OpClose, "\x03\xe8")
+}
+
+func TestWebSocketInterception(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(webSocketEcho))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(webSocketEcho))
+	defer secure.Close()
+	authority := secure.Listener.Addr().String()
+
+	p, proxyAddr := startTestProxy(t)
+	p.Plugins.Register(&webSocketPlugin{})
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+
+	// handshake opens a WebSocket over an HTTP/1.1 connection to the proxy
+	handshake := func(t *testing.T, conn net.Conn, target, host string) io.Reader {
+		fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n", target, host)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf("failed to read handshake response: %v", err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+			t.Fatalf("expected WebSocket handshake to succeed, got %s %v", resp.Status, resp.Header)
+		}
+		return reader
+	}
+
+	tests := []struct {
+		proto string
+		open  func(t *testing.T) (io.Reader, io.Writer)
+	}{
+		{"HTTP", func(t *testing.T) (io.Reader, io.Writer) {
+			conn, err := net.Dial("tcp", proxyAddr)
+			if err != nil {
+				t.Fatalf("failed to dial proxy: %v", err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			host := plain.Listener.Addr().String()
+			return handshake(t, conn, "http://"+host+"/ws", host), conn
+		}},
+		{"HTTPS", func(t *testing.T) (io.Reader, io.Writer) {
+			tlsConn := connectTLS(t, p, proxyAddr, authority, "127.0.0.1")
+			return handshake(t, tlsConn, "/ws", authority), tlsConn
+		}},
+		{"HTTPS/2", func(t *testing.T) (io.Reader, io.Writer) {
+			roots := x509.NewCertPool()
+			roots.AddCert(p.CA.Cert)
+			tlsConn := tls.Client(dialTunnel(t, proxyAddr, authority), &tls.Config{
+				RootCAs:    roots,
+				ServerName: "127.0.0.1",
+				NextProtos: []string{"h2"},
+			})
+			cc, err := (&http2.Transport{}).NewClientConn(tlsConn)
+			if err != nil {
+				t.Fatalf("failed to start h2 client: %v", err)
+			}
+			body, w := io.Pipe()
+			t.Cleanup(func() { w.Close() })
+			req, _ := http.NewRequest(http.MethodConnect, "https://"+authority+"/ws", body)
+			req.Header.Set(":protocol", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			resp, err := cc.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("extended CONNECT failed: %v", err)
+			}
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected extended CONNECT to succeed, got %s", resp.Status)
+			}
+			return resp.Body, w
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			r, w := tt.open(t)
+			exchangeWebSocketFrames(t, r, w)
+
+			conns := p.WebSockets()
+			ws := conns[len(conns)-1]
+			if ws.Proto != tt.proto || !strings.HasSuffix(ws.URL, "/ws") {
+				t.Errorf("expected %s connection to /ws, got %s %s", tt.proto, ws.Proto, ws.URL)
+			}
+			var dropped, injected bool
+			for _, frame := range ws.Messages {
+				dropped = dropped || (frame.Dropped && frame.Payload == "drop")
+				injected = injected || (frame.Injected && frame.Payload == "injected" && !frame.FromClient)
+			}
+			if !dropped || !injected {
+				t.Errorf("expected dropped and injected frames to be recorded, got %+v", ws.Messages)
+			}
+		})
+	}
+}
+
+func TestReverseMode(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Saw", r.Header.Get("X-Intercepted"))
+		fmt.Fprintf(w, "%s %s", r.Host, r.URL.RequestURI())
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	target, _ := url.Parse(upstream.URL + "/api/")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	p := newTestProxy(t, listener.Addr().String())
+	p.Mode = ModeReverse
+	p.ReverseTarget = target
+	p.Plugins.Register(&markerPlugin{})
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	go p.Serve(listener)
+	proxyAddr := listener.Addr().String()
+
+	// Clients name the proxy; the certificate is minted for that name
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	clientTLS := func(protos ...string) *tls.Config {
+		return &tls.Config{RootCAs: roots, ServerName: "api.reverse.test", NextProtos: protos}
+	}
+
+	tests := []struct {
+		proto     string
+		url       string
+		transport http.RoundTripper
+	}{
+		{"HTTP", "http://" + proxyAddr, &http.Transport{}},
+		{"HTTPS", "https://" + proxyAddr, &http.Transport{TLSClientConfig: clientTLS("http/1.1")}},
+		{"HTTPS/2", "https://" + proxyAddr, &http2.Transport{TLSClientConfig: clientTLS("h2")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proto, func(t *testing.T) {
+			resp, err := (&http.Client{Transport: tt.transport}).Get(tt.url + "/users?page=2")
+			if err != nil {
+				t.Fatalf("request to reverse proxy failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// The upstream sees its own name and the path below the target
+			want := target.Host + " /api/users?page=2"
+			if string(body) != want {
+				t.Errorf("expected upstream to answer %q, got %q", want, body)
+			}
+			if got := resp.Header.Get("X-Saw"); got != "request" {
+				t.Errorf("expected request hook to reach upstream, got %q", got)
+			}
+			if got := resp.Header.Get("X-Intercepted"); got != "response" {
+				t.Errorf("expected response hook to run, got %q", got)
+			}
+
+			flows := p.Flows()
+			flow := flows[len(flows)-1]
+			if flow.Proto != tt.proto || flow.URL != upstream.URL+"/api/users?page=2" {
+				t.Errorf("expected %s flow for the upstream, got %s %s", tt.proto, flow.Proto, flow.URL)
+			}
+		})
+	}
+
+	// The dashboard stays reachable by name
+	req, _ := http.NewRequest(http.MethodGet, "http://"+proxyAddr+"/stats", nil)
+	req.Host = "interceptify.local"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("dashboard request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Intercepted") != "" {
+		t.Errorf("expected dashboard response, got %s", resp.Status)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "upstream %s", r.Host)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	// Echoes one line back, for a protocol the proxy does not recognise
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	echo := &countingListener{Listener: echoListener}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			io.WriteString(conn, line)
+			conn.Close()
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	p := newTestProxy(t, "127.0.0.1:0")
+	p.SOCKSUsers = map[string]string{"alice": "secret"}
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	go p.ServeSOCKS(listener)
+
+	dialer, err := xproxy.SOCKS5("tcp", listener.Addr().String(), &xproxy.Auth{User: "alice", Password: "secret"}, xproxy.Direct)
+	if err != nil {
+		t.Fatalf("failed to create SOCKS5 dialer: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext:     dialer.(xproxy.ContextDialer).DialContext,
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}}
+
+	// Only the proxy CA is trusted, so the HTTPS request succeeds only if
+	// it was intercepted
+	for _, tt := range []struct {
+		proto string
+		url   string
+	}{
+		{"HTTP", plain.URL + "/"},
+		{"HTTPS", secure.URL + "/"},
+	} {
+		t.Run(tt.proto, func(t *testing.T) {
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("request through SOCKS5 failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "upstream "+resp.Request.URL.Host {
+				t.Errorf("unexpected body %q", body)
+			}
+
+			flows := p.Flows()
+			flow := flows[len(flows)-1]
+			if flow.Proto != tt.proto || flow.URL != tt.url {
+				t.Errorf("expected %s flow for %s, got %s %s", tt.proto, tt.url, flow.Proto, flow.URL)
+			}
+		})
+	}
+
+	t.Run("raw TCP", func(t *testing.T) {
+		conn, err := dialer.Dial("tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial through SOCKS5: %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "hello, echo\n")
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "hello, echo\n" {
+			t.Errorf("expected line to be relayed, got %q (err: %v)", line, err)
+		}
+		// The connection dialled before replying carries the tunnel
+		if got := echo.accepted.Load(); got != 1 {
+			t.Errorf("expected 1 upstream connection, got %d", got)
+		}
+	})
+
+	t.Run("bad credentials", func(t *testing.T) {
+		dialer, _ := xproxy.SOCKS5("tcp", listener.Addr().String(), &xproxy.Auth{User: "alice", Password: "wrong"}, xproxy.Direct)
+		if conn, err := dialer.Dial("tcp", echo.Addr().String()); err == nil {
+			conn.Close()
+			t.Error("expected SOCKS5 authentication to fail")
+		}
+	})
+
+	// Destinations are dialled before replying, so the client learns why
+	// one could not be reached, whether or not it would be intercepted
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closed.Close()
+	for _, passthrough := range []bool{false, true} {
+		t.Run(fmt.Sprintf("refused passthrough=%t", passthrough), func(t *testing.T) {
+			if passthrough {
+				p.Passthrough, _ = ParseHostPatterns([]string{"127.0.0.1"})
+			}
+			_, err := dialer.Dial("tcp", closed.Addr().String())
+			if err == nil || !strings.Contains(err.Error(), "connection refused") {
+				t.Errorf("expected connection refused reply, got %v", err)
+			}
+		})
+	}
+}
+
+// chainProxy is a minimal HTTP proxy requiring basic auth, recording the
+// requests it serves
+type chainProxy struct {
+	mu   sync.Mutex
+	seen []string
+}
+
+func (c *chainProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("bob:hunter2")) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	c.mu.Lock()
+	c.seen = append(c.seen, r.Method+" "+r.Host)
+	c.mu.Unlock()
+
+	if r.Method != http.MethodConnect {
+		r.RequestURI = ""
+		r.Header.Del("Proxy-Authorization")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		copyResponse(w, resp)
+		return
+	}
+
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+	go io.Copy(upstream, buf)
+	io.Copy(conn, upstream)
+}
+
+func (c *chainProxy) requests() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.seen...)
+}
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func TestUpstreamProxyChaining(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "upstream %s", r.Proto)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.EnableHTTP2 = true
+	secure.StartTLS()
+	defer secure.Close()
+
+	httpChain := &chainProxy{}
+	httpUpstream := httptest.NewServer(httpChain)
+	defer httpUpstream.Close()
+
+	// A second proxy relays everything it is sent over SOCKS5
+	socksListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	socksCounter := &countingListener{Listener: socksListener}
+	defer socksCounter.Close()
+	socksUpstream := newTestProxy(t, "127.0.0.1:0")
+	socksUpstream.Passthrough, _ = ParseHostPatterns([]string{"*"})
+	socksUpstream.SOCKSUsers = map[string]string{"carol": "s3cret"}
+	go socksUpstream.ServeSOCKS(socksCounter)
+
+	p, proxyAddr := startTestProxy(t)
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"127.0.0.1", "localhost"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+	err = p.ConfigureUpstreamProxies(UpstreamProxyConfig{
+		Default: "http://bob:hunter2@" + httpUpstream.Listener.Addr().String(),
+		Proxies: map[string]string{"lab": "socks5://carol:s3cret@" + socksListener.Addr().String()},
+		Routes:  []UpstreamRouteConfig{{Host: "localhost", Via: "lab"}},
+	})
+	if err != nil {
+		t.Fatalf("failed to configure upstream proxies: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	proxyURL, _ := url.Parse("http://" + proxyAddr)
+	client := func(h2 bool) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxyURL),
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: h2,
+		}}
+	}
+	_, securePort, _ := net.SplitHostPort(secure.Listener.Addr().String())
+
+	tests := []struct {
+		name  string
+		url   string
+		h2    bool
+		proto string
+		// via is what the HTTP upstream proxy sees; empty for SOCKS5
+		via string
+	}{
+		{"HTTP", plain.URL + "/", false, "HTTP", "GET " + plain.Listener.Addr().String()},
+		{"HTTPS", secure.URL + "/", false, "HTTPS", "CONNECT " + secure.Listener.Addr().String()},
+		{"HTTPS/2", secure.URL + "/", true, "HTTPS/2", "CONNECT " + secure.Listener.Addr().String()},
+		{"SOCKS5 route", "https://localhost:" + securePort + "/", true, "HTTPS/2", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, accepted := len(httpChain.requests()), socksCounter.accepted.Load()
+
+			resp, err := client(tt.h2).Get(tt.url)
+			if err != nil {
+				t.Fatalf("request through proxy failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("expected 200, got %s: %s", resp.Status, body)
+			}
+			// h2 clients are re-originated over h2 through the chain too
+			if tt.h2 && string(body) != "upstream HTTP/2.0" {
+				t.Errorf("expected upstream to be reached over h2, got %q", body)
+			}
+
+			flows := p.Flows()
+			if flow := flows[len(flows)-1]; flow.Proto != tt.proto {
+				t.Errorf("expected %s flow, got %s", tt.proto, flow.Proto)
+			}
+
+			seen := httpChain.requests()[before:]
+			if tt.via == "" {
+				if len(seen) != 0 || socksCounter.accepted.Load() == accepted {
+					t.Errorf("expected request to go through SOCKS5 only, HTTP proxy saw %v", seen)
+				}
+				return
+			}
+			if !slices.Contains(seen, tt.via) {
+				t.Errorf("expected HTTP upstream proxy to see %q, got %v", tt.via, seen)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxyRoutes(t *testing.T) {
+	p := newTestProxy(t, "127.0.0.1:0")
+	err := p.ConfigureUpstreamProxies(UpstreamProxyConfig{
+		Default: "http://corp-proxy:3128",
+		Proxies: map[string]string{"Lab": "socks5://10.0.0.5"},
+		Routes: []UpstreamRouteConfig{
+			{Host: "*.corp.internal", Via: "direct"},
+			{Host: "*.lab.example.com", Via: "lab"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to configure upstream proxies: %v", err)
+	}
+
+	for host, want := range map[string]string{
+		"git.corp.internal":   "",
+		"api.lab.example.com": "lab",
+		"example.org":         "default",
+	} {
+		got := ""
+		if up := p.upstreamProxyFor(host); up != nil {
+			got = up.name
+		}
+		if got != want {
+			t.Errorf("expected %s to route via %q, got %q", host, want, got)
+		}
+	}
+
+	for _, cfg := range []UpstreamProxyConfig{
+		{Default: "ftp://proxy:21"},
+		{Routes: []UpstreamRouteConfig{{Host: "*", Via: "missing"}}},
+		{Proxies: map[string]string{"direct": "http://proxy:3128"}},
+	} {
+		if err := p.ConfigureUpstreamProxies(cfg); err == nil {
+			t.Errorf("expected %+v to be rejected", cfg)
+		}
+	}
+}
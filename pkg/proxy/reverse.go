@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// handleReverse serves a client of the reverse proxy. TLS is terminated
+// with a certificate for the name the client asked for; plaintext HTTP is
+// served as-is. Either way, requests are sent to ReverseTarget.
+func (p *Proxy) handleReverse(conn net.Conn) {
+	defer conn.Close()
+
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	switch sniffProtocol(bc) {
+	case protocolTLS:
+		p.serveReverseTLS(bc)
+	case protocolHTTP:
+		p.serveReverse(bc, nil)
+	default:
+		log.Printf("Closing non-HTTP connection from %s to the reverse proxy", conn.RemoteAddr())
+	}
+}
+
+// reverseAuthority is the host:port of the reverse proxy target
+func (p *Proxy) reverseAuthority() string {
+	if p.ReverseTarget.Scheme == "https" {
+		return withDefaultPort(p.ReverseTarget.Host, "443")
+	}
+	return withDefaultPort(p.ReverseTarget.Host, "80")
+}
+
+// serveReverseTLS terminates TLS for a reverse proxy client
+func (p *Proxy) serveReverseTLS(conn *bufferedConn) {
+	authority := p.reverseAuthority()
+
+	var upstreamProto string
+	serverConfig := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg := &tls.Config{
+				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					// Clients name the proxy, not the target; without SNI the
+					// address they connected to is used
+					name := certName(conn.LocalAddr().String(), hello.ServerName)
+					if cert := p.overrideFor(name); cert != nil {
+						return cert, nil
+					}
+					cert, err := p.CA.Certificate(name)
+					if err != nil {
+						log.Printf("failed to sign certificate for %s: %v", name, err)
+					}
+					return cert, err
+				},
+				ClientAuth: p.ClientAuth,
+			}
+			if p.ReverseTarget.Scheme == "https" {
+				cfg.NextProtos, upstreamProto = p.mirrorALPN(authority, "", hello.SupportedProtos)
+			} else {
+				// h2 clients are translated to HTTP/1.1
+				cfg.NextProtos, upstreamProto = proxyProtos, "http/1.1"
+			}
+			return cfg, nil
+		},
+	}
+
+	tlsConn := tls.Server(conn, serverConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("TLS handshake with reverse proxy client %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer tlsConn.Close()
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+		p.handleHTTPS2(tlsConn, authority, upstreamProto)
+		return
+	}
+	state := tlsConn.ConnectionState()
+	p.serveReverse(&bufferedConn{Conn: tlsConn, r: bufio.NewReader(tlsConn)}, &state)
+}
+
+// serveReverse serves HTTP/1.x requests from a reverse proxy client,
+// sending each to ReverseTarget. state is the client's TLS state, if any.
+func (p *Proxy) serveReverse(conn *bufferedConn, state *tls.ConnectionState) {
+	ex := exchange{client: clientHost(conn), proto: "HTTP", clientTLS: state}
+	if state != nil {
+		ex.proto = "HTTPS"
+	}
+
+	for {
+		req, err := http.ReadRequest(conn.r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read reverse proxy request: %v", err)
+			}
+			return
+		}
+		if isDashboardHost(req.Host) {
+			p.handleDashboard(conn, req)
+			return
+		}
+
+		req.TLS = state
+		p.reverseURL(req)
+		if isWebSocket(req) {
+			p.handleWebSocket(conn, ex, req)
+			return
+		}
+
+		keepAlive := p.forward(conn, ex, req)
+		req.Body.Close()
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// reverseURL points an origin-form request at ReverseTarget, below the
+// target's path. The target is sent its own name as Host, as if it were
+// reached directly.
+func (p *Proxy) reverseURL(req *http.Request) {
+	target := p.ReverseTarget
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	if base := strings.TrimSuffix(target.Path, "/"); base != "" {
+		req.URL.Path = base + req.URL.Path
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimSuffix(target.EscapedPath(), "/") + req.URL.RawPath
+		}
+	}
+	req.Host = target.Host
+}
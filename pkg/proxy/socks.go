@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// socksHandshakeTimeout bounds how long a SOCKS client may take to
+// authenticate and name its destination
+const socksHandshakeTimeout = 10 * time.Second
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929)
+const (
+	socksVersion = 0x05
+
+	socksMethodNone         = 0x00
+	socksMethodPassword     = 0x02
+	socksMethodUnacceptable = 0xff
+
+	socksPasswordVersion = 0x01
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNetworkUnreachable  = 0x03
+	socksHostUnreachable     = 0x04
+	socksConnectionRefused   = 0x05
+	socksCmdNotSupported     = 0x07
+	socksAddrTypeUnsupported = 0x08
+)
+
+// ParseSOCKSUsers parses user:password entries into the credentials
+// accepted from SOCKS5 clients
+func ParseSOCKSUsers(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	users := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		user, password, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid SOCKS credentials %q (expected user:password)", entry)
+		}
+		// RFC 1929 encodes both in at most 255 bytes
+		if len(user) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("SOCKS credentials for %q exceed 255 bytes", user)
+		}
+		users[user] = password
+	}
+	return users, nil
+}
+
+// ServeSOCKS accepts SOCKS5 connections on listener until it is closed
+func (p *Proxy) ServeSOCKS(listener net.Listener) error {
+	defer listener.Close()
+
+	log.Printf("Interceptify SOCKS5 proxy listening on %s", listener.Addr())
+
+	p.startEvents()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("failed to accept SOCKS connection: %v", err)
+			continue
+		}
+
+		go p.handleSOCKS(conn)
+	}
+}
+
+// handleSOCKS serves a SOCKS5 client. A CONNECT is treated like an HTTP
+// CONNECT tunnel: TLS is intercepted, plaintext HTTP goes through the HTTP
+// pipeline, and anything else is relayed. The destination is dialled before
+// the reply, so failures reach the client as SOCKS errors, and the tunnel's
+// first upstream dial to it reuses that connection.
+func (p *Proxy) handleSOCKS(conn net.Conn) {
+	defer conn.Close()
+
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	authority, err := p.socksHandshake(bc)
+	if err != nil {
+		log.Printf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("SOCKS5 Tunnel Request: %s", authority)
+	p.logEvent(fmt.Sprintf("SOCKS5: %s", authority))
+
+	upstream, err := p.dialUpstream(context.Background(), "tcp", authority)
+	if err != nil {
+		log.Printf("failed to connect to %s: %v", authority, err)
+		writeSOCKSReply(bc, socksReplyCode(err), nil)
+		return
+	}
+	p.parked.park("tcp", authority, upstream)
+	// Unless the tunnel took it over, e.g. because a pooled connection
+	// served its requests, the connection is closed with the tunnel
+	defer func() {
+		if p.parked.remove("tcp", authority, upstream) {
+			upstream.Close()
+		}
+	}()
+
+	if err := writeSOCKSReply(bc, socksSucceeded, upstream.LocalAddr()); err != nil {
+		return
+	}
+
+	if p.passthrough(authority) {
+		p.handlePassthrough(bc, authority, "", true)
+		return
+	}
+	p.handleTunnel(bc, authority, p.PassthroughSNI)
+}
+
+// socksReplyCode maps an error dialling the destination to a SOCKS reply
+func socksReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socksHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksHandshake negotiates authentication and reads the client's request,
+// returning the destination host:port. Failures are answered as the
+// protocol requires before they are returned.
+func (p *Proxy) socksHandshake(conn *bufferedConn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn.r, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn.r, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(socksMethodNone)
+	if len(p.SOCKSUsers) > 0 {
+		method = socksMethodPassword
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{socksVersion, socksMethodUnacceptable})
+		return "", fmt.Errorf("client offered no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksMethodPassword {
+		if err := p.socksAuthenticate(conn); err != nil {
+			return "", err
+		}
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(conn.r, request[:]); err != nil {
+		return "", err
+	}
+	if request[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", request[0])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn.r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		n, err := conn.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(conn.r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		writeSOCKSReply(conn, socksAddrTypeUnsupported, nil)
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn.r, port[:]); err != nil {
+		return "", err
+	}
+
+	// Only CONNECT can be intercepted; BIND and UDP ASSOCIATE are refused
+	if request[1] != socksCmdConnect {
+		writeSOCKSReply(conn, socksCmdNotSupported, nil)
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksAuthenticate performs username/password authentication (RFC 1929)
+func (p *Proxy) socksAuthenticate(conn *bufferedConn) error {
+	version, err := conn.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socksPasswordVersion {
+		return fmt.Errorf("unsupported authentication version %d", version)
+	}
+	readField := func() (string, error) {
+		n, err := conn.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(conn.r, b)
+		return string(b), err
+	}
+	user, err := readField()
+	if err != nil {
+		return err
+	}
+	password, err := readField()
+	if err != nil {
+		return err
+	}
+
+	want, ok := p.SOCKSUsers[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(want)) != 1 {
+		conn.Write([]byte{socksPasswordVersion, 0x01})
+		return fmt.Errorf("invalid credentials for user %q", user)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, 0x00})
+	return err
+}
+
+// writeSOCKSReply answers a SOCKS request with code, reporting bound as the
+// address the proxy connected from
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	reply := []byte{socksVersion, code, 0x00}
+	ip, port := net.IPv4zero.To4(), 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+	}
+	if len(ip) == net.IPv4len {
+		reply = append(reply, socksAddrIPv4)
+	} else {
+		reply = append(reply, socksAddrIPv6)
+	}
+	reply = append(reply, ip...)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(port))
+	_, err := w.Write(reply)
+	return err
+}
+
+// parkedConns holds upstream connections dialled to check that a SOCKS
+// destination is reachable, until the tunnel's first dial to it takes one
+type parkedConns struct {
+	mu    sync.Mutex
+	conns map[string][]net.Conn
+}
+
+func (pc *parkedConns) park(network, addr string, conn net.Conn) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.conns == nil {
+		pc.conns = make(map[string][]net.Conn)
+	}
+	key := network + "|" + addr
+	pc.conns[key] = append(pc.conns[key], conn)
+}
+
+// take removes and returns a connection parked for addr, if any
+func (pc *parkedConns) take(network, addr string) net.Conn {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	key := network + "|" + addr
+	conns := pc.conns[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	if len(conns) == 1 {
+		delete(pc.conns, key)
+	} else {
+		pc.conns[key] = conns[:len(conns)-1]
+	}
+	return conn
+}
+
+// remove unparks conn, reporting whether it was still parked
+func (pc *parkedConns) remove(network, addr string, conn net.Conn) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	key := network + "|" + addr
+	conns := pc.conns[key]
+	i := slices.Index(conns, conn)
+	if i < 0 {
+		return false
+	}
+	conns = slices.Delete(conns, i, i+1)
+	if len(conns) == 0 {
+		delete(pc.conns, key)
+	} else {
+		pc.conns[key] = conns
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+)
+
+// handleTransparent serves a connection that was redirected to the proxy.
+// The client believes it is talking to the original destination, so the
+// stream is handled as if it arrived through a tunnel to that address.
+func (p *Proxy) handleTransparent(conn net.Conn) {
+	dst, err := originalDst(conn)
+	if err != nil || isLocalAddr(conn, dst) {
+		// Connections addressed to the proxy itself, e.g. from clients
+		// configured to use it or the dashboard, are served normally
+		p.handleConnection(conn)
+		return
+	}
+	defer conn.Close()
+
+	authority := dst.String()
+	log.Printf("Transparent connection from %s to %s", conn.RemoteAddr(), authority)
+	p.logEvent(fmt.Sprintf("TRANSPARENT: %s", authority))
+
+	bc := &bufferedConn{Conn: conn, r: bufio.NewReader(conn)}
+	if p.passthrough(authority) {
+		p.handlePassthrough(bc, authority, "", true)
+		return
+	}
+
+	// There is no CONNECT request naming the host, so the ClientHello SNI is
+	// used where a name is needed. Plain HTTP goes to the address the client
+	// connected to, whatever its Host header names.
+	switch sniffProtocol(bc) {
+	case protocolHTTP:
+		p.handleTunnelHTTP(bc, authority)
+	default:
+		p.handleTunnel(bc, authority, true)
+	}
+}
+
+// isLocalAddr reports whether dst is the address conn was accepted on
+func isLocalAddr(conn net.Conn, dst *net.TCPAddr) bool {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	return ok && local.Port == dst.Port && local.IP.Equal(dst.IP)
+}
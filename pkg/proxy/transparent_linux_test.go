@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsEnv marks the copy of the test binary running inside its own
+// network namespace
+const netnsEnv = "INTERCEPTIFY_TEST_NETNS"
+
+// TestTransparentMode redirects connections to a transparent proxy with
+// iptables inside a private network namespace. It needs root and iptables.
+func TestTransparentMode(t *testing.T) {
+	if os.Getenv(netnsEnv) == "" {
+		if os.Geteuid() != 0 {
+			t.Skip("transparent mode test requires root")
+		}
+		for _, tool := range []string{"ip", "iptables", "ip6tables"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				t.Skipf("transparent mode test requires %s", tool)
+			}
+		}
+
+		// Rerun just this test in a fresh network namespace, so the
+		// firewall rules cannot affect the host
+		cmd := exec.Command(os.Args[0], "-test.run=^TestTransparentMode$", "-test.v")
+		cmd.Env = append(os.Environ(), netnsEnv+"=1")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("test in network namespace failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	// 10.99.0.1 and fd00:99::1 host the upstream servers; clients connect
+	// from 10.99.0.2 and fd00:99::2, whose traffic is redirected
+	for _, args := range [][]string{
+		{"ip", "link", "set", "lo", "up"},
+		{"ip", "addr", "add", "10.99.0.1/32", "dev", "lo"},
+		{"ip", "addr", "add", "10.99.0.2/32", "dev", "lo"},
+		{"ip", "-6", "addr", "add", "fd00:99::1/128", "dev", "lo", "nodad"},
+		{"ip", "-6", "addr", "add", "fd00:99::2/128", "dev", "lo", "nodad"},
+	} {
+		if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	// Redirected IPv4 connections arrive at 127.0.0.1 and IPv6 ones at ::1
+	listener, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	p := newTestProxy(t, listener.Addr().String())
+	p.Mode = ModeTransparent
+	go p.Serve(listener)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	for _, rule := range [][]string{
+		{"iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-s", "10.99.0.2", "-j", "REDIRECT", "--to-ports", port},
+		{"ip6tables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-s", "fd00:99::2", "-j", "REDIRECT", "--to-ports", port},
+	} {
+		if out, err := exec.Command(rule[0], rule[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v failed: %v\n%s", rule, err, out)
+		}
+	}
+	if err := p.ConfigureUpstreamTLS(UpstreamTLSConfig{Insecure: []string{"10.99.0.1", "fd00:99::1"}}); err != nil {
+		t.Fatalf("failed to configure upstream TLS: %v", err)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "upstream %s", r.Host)
+	})
+	serve := func(addr string, secure bool) string {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %s: %v", addr, err)
+		}
+		server := &httptest.Server{Listener: l, Config: &http.Server{Handler: handler}}
+		if secure {
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		t.Cleanup(server.Close)
+		return l.Addr().String()
+	}
+
+	// Only the proxy CA is trusted, so HTTPS requests succeed only if intercepted
+	roots := x509.NewCertPool()
+	roots.AddCert(p.CA.Cert)
+	client := func(source string) *http.Client {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)}}
+		return &http.Client{Transport: &http.Transport{
+			DialContext:     dialer.DialContext,
+			TLSClientConfig: &tls.Config{RootCAs: roots},
+		}}
+	}
+
+	tests := []struct {
+		name   string
+		source string
+		url    string
+		proto  string
+	}{
+		{"IPv4 HTTP", "10.99.0.2", "http://" + serve("10.99.0.1:0", false), "HTTP"},
+		{"IPv4 HTTPS", "10.99.0.2", "https://" + serve("10.99.0.1:0", true), "HTTPS"},
+		{"IPv6 HTTP", "fd00:99::2", "http://" + serve("[fd00:99::1]:0", false), "HTTP"},
+		{"IPv6 HTTPS", "fd00:99::2", "https://" + serve("[fd00:99::1]:0", true), "HTTPS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := client(tt.source).Get(tt.url + "/")
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "upstream "+resp.Request.URL.Host {
+				t.Errorf("unexpected body %q", body)
+			}
+
+			flows := p.Flows()
+			flow := flows[len(flows)-1]
+			if flow.Proto != tt.proto || flow.URL != tt.url+"/" {
+				t.Errorf("expected %s flow for %s/, got %s %s", tt.proto, tt.url, flow.Proto, flow.URL)
+			}
+		})
+	}
+
+	// Plain HTTP goes where the client connected, not where its Host header
+	// points: nothing listens on 10.99.0.1:1
+	t.Run("Host mismatch", func(t *testing.T) {
+		target := tests[0].url
+		req, _ := http.NewRequest(http.MethodGet, target+"/", nil)
+		req.Host = "10.99.0.1:1"
+		resp, err := client("10.99.0.2").Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(body) != "upstream 10.99.0.1:1" {
+			t.Errorf("expected original destination %s to serve the request, got %d %q", target, resp.StatusCode, body)
+		}
+	})
+
+	// Connections made to the proxy itself are served as an explicit proxy
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "GET http://interceptify.local/stats HTTP/1.1\r\nHost: interceptify.local\r\n\r\n")
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "HTTP/1.1 200" {
+		t.Errorf("expected dashboard response from direct connection, got %q (err: %v)", buf, err)
+	}
+}
+
+// TestOriginalDstDecoding decodes SO_ORIGINAL_DST results laid out as the
+// kernel writes them, without needing root or netfilter
+func TestOriginalDstDecoding(t *testing.T) {
+	// struct sockaddr_in: family in host order, then port and address in
+	// network order
+	sin := binary.NativeEndian.AppendUint16(nil, unix.AF_INET)
+	sin = binary.BigEndian.AppendUint16(sin, 8443)
+	sin = append(sin, 192, 0, 2, 10)
+	var mreq unix.IPv6Mreq
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&mreq)), unsafe.Sizeof(mreq)), sin)
+	if got := decodeOriginalDst4(&mreq); got.String() != "192.0.2.10:8443" {
+		t.Errorf("expected 192.0.2.10:8443, got %s", got)
+	}
+
+	// struct sockaddr_in6: family, port, flow info, address, scope id
+	ip := net.ParseIP("2001:db8::1")
+	sin6 := binary.NativeEndian.AppendUint16(nil, unix.AF_INET6)
+	sin6 = binary.BigEndian.AppendUint16(sin6, 8443)
+	sin6 = binary.BigEndian.AppendUint32(sin6, 0)
+	sin6 = append(sin6, ip...)
+	var info unix.IPv6MTUInfo
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&info)), unsafe.Sizeof(info)), sin6)
+	if got := decodeOriginalDst6(&info); got.String() != "[2001:db8::1]:8443" {
+		t.Errorf("expected [2001:db8::1]:8443, got %s", got)
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sniffTimeout bounds how long a tunnel waits for the client's first bytes.
+// Clients of server-speaks-first protocols (SMTP, FTP) send nothing, so the
+// tunnel is relayed opaquely once it expires.
+const sniffTimeout = 3 * time.Second
+
+// maxMethodLen is the length of the longest method in httpMethods plus a space
+const maxMethodLen = len("OPTIONS ")
+
+// httpMethods are the request methods recognised when sniffing a tunnel
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE"}
+
+// tunnelProtocol is the protocol a client speaks inside a CONNECT tunnel
+type tunnelProtocol int
+
+const (
+	protocolOpaque tunnelProtocol = iota
+	protocolTLS
+	protocolHTTP
+)
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader, so
+// bytes that were peeked or read ahead are not lost
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// sniffProtocol peeks at the first bytes the client sends through a tunnel
+// to tell TLS and plaintext HTTP apart from anything else
+func sniffProtocol(conn *bufferedConn) tunnelProtocol {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return protocolOpaque
+	}
+	if first[0] == tlsRecordTypeHandshake {
+		return protocolTLS
+	}
+
+	// Look for a known method followed by a space, one byte at a time so a
+	// short non-HTTP greeting is not waited on
+	for n := 1; n <= maxMethodLen; n++ {
+		prefix, err := conn.r.Peek(n)
+		if err != nil {
+			return protocolOpaque
+		}
+		c := prefix[n-1]
+		if c == ' ' {
+			method := string(prefix[:n-1])
+			for _, m := range httpMethods {
+				if method == m {
+					return protocolHTTP
+				}
+			}
+			return protocolOpaque
+		}
+		if c < 'A' || c > 'Z' {
+			return protocolOpaque
+		}
+	}
+	return protocolOpaque
+}
+
+// handleTunnelHTTP serves plaintext HTTP requests sent inside a tunnel to
+// authority through the regular HTTP pipeline. Requests always go to
+// authority; their Host header is forwarded but not used for routing.
+func (p *Proxy) handleTunnelHTTP(conn *bufferedConn, authority string) {
+	for {
+		req, err := http.ReadRequest(conn.r)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("failed to read tunnelled request: %v", err)
+			}
+			return
+		}
+
+		req.URL.Scheme = "http"
+		req.URL.Host = authority
+		if isWebSocket(req) {
+			p.handleWebSocket(conn, exchange{client: clientHost(conn), proto: "HTTP"}, req)
+			return
+		}
+		// Other protocol upgrades take over the connection, so the
+		// handshake and everything after it are relayed as-is
+		if isUpgrade(req) {
+			p.relayRequest(conn, authority, req)
+			return
+		}
+
+		keepAlive := p.handleHTTP(conn, req)
+		req.Body.Close()
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// isUpgrade reports whether req asks to switch protocols
+func isUpgrade(req *http.Request) bool {
+	return headerHasToken(req.Header, "Connection", "upgrade")
+}
+
+// relayRequest writes req to authority and then relays the connection opaquely
+func (p *Proxy) relayRequest(conn *bufferedConn, authority string, req *http.Request) {
+	upstream, err := p.dialUpstream(context.Background(), "tcp", authority)
+	if err != nil {
+		log.Printf("failed to connect to %s: %v", authority, err)
+		return
+	}
+	defer upstream.Close()
+
+	if err := req.Write(upstream); err != nil {
+		log.Printf("failed to forward upgrade request to %s: %v", authority, err)
+		return
+	}
+	p.splice(conn, upstream, "OPAQUE", fmt.Sprintf("%s (%s upgrade)", authority, req.Header.Get("Upgrade")))
+}
+
+// relay connects the client to authority and splices bytes between them.
+// established is set when the CONNECT has already been acknowledged;
+// otherwise the acknowledgement (or a 502) is written here.
+func (p *Proxy) relay(conn net.Conn, authority, kind, label string, established bool) {
+	upstream, err := p.dialUpstream(context.Background(), "tcp", withDefaultPort(authority, "443"))
+	if err != nil {
+		log.Printf("failed to connect to %s: %v", authority, err)
+		if !established {
+			conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		}
+		return
+	}
+	defer upstream.Close()
+
+	if !established {
+		conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	}
+	p.splice(conn, upstream, kind, label)
+}
+
+// splice relays bytes between the client and upstream until both directions
+// finish, then reports the transfer on the dashboard as a kind event
+func (p *Proxy) splice(client net.Conn, upstream net.Conn, kind, label string) {
+	start := time.Now()
+
+	var sent, received int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent, _ = io.Copy(upstream, client)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		received, _ = io.Copy(client, upstream)
+		closeWrite(client)
+	}()
+	wg.Wait()
+
+	duration := time.Since(start).Round(time.Millisecond)
+	log.Printf("%s tunnel %s closed: %d bytes sent, %d bytes received in %s", kind, label, sent, received, duration)
+	p.logEvent(fmt.Sprintf("%s: %s sent=%d received=%d duration=%s", kind, label, sent, received, duration))
+}
+
+// closeWrite half-closes conn so the peer sees EOF while replies can still arrive
+func closeWrite(conn net.Conn) {
+	if bc, ok := conn.(*bufferedConn); ok {
+		conn = bc.Conn
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
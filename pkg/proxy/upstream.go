@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ismailtsdln/interceptify/pkg/ca"
+	"golang.org/x/net/http2"
+)
+
+// UpstreamTLSConfig controls how certificates of upstream servers are verified
+type UpstreamTLSConfig struct {
+	// RootCAs are PEM files trusted in addition to the system roots
+	RootCAs []string `mapstructure:"root_cas"`
+	// MinVersion is the lowest TLS version accepted upstream ("1.0" to "1.3")
+	MinVersion string `mapstructure:"min_version"`
+	// Insecure lists host patterns whose certificates are not verified
+	Insecure []string `mapstructure:"insecure"`
+	// Pins requires matching hosts to present a certificate with one of the fingerprints
+	Pins []UpstreamPinConfig `mapstructure:"pins"`
+}
+
+// UpstreamPinConfig pins a host pattern to SHA-256 certificate fingerprints.
+// A pin matches any certificate in the presented chain.
+type UpstreamPinConfig struct {
+	Host   string   `mapstructure:"host"`
+	SHA256 []string `mapstructure:"sha256"`
+}
+
+type upstreamPin struct {
+	pattern      HostPattern
+	fingerprints map[string]bool
+}
+
+// upstreamTLSPolicy is the compiled form of UpstreamTLSConfig
+type upstreamTLSPolicy struct {
+	roots      *x509.CertPool
+	minVersion uint16
+	insecure   []HostPattern
+	pins       []upstreamPin
+}
+
+// UpstreamTLSError reports an upstream certificate that failed verification
+type UpstreamTLSError struct {
+	Host  string
+	Chain []*x509.Certificate
+	Err   error
+}
+
+func (e *UpstreamTLSError) Error() string {
+	return fmt.Sprintf("upstream certificate verification failed for %s: %v", e.Host, e.Err)
+}
+
+func (e *UpstreamTLSError) Unwrap() error {
+	return e.Err
+}
+
+// tlsVersions maps configuration names to TLS protocol versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2"
+func ParseTLSVersion(s string) (uint16, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.TrimSpace(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q (expected 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+	return version, nil
+}
+
+// ConfigureUpstreamTLS sets the verification policy for connections the
+// proxy makes to upstream servers. It must be called before serving.
+func (p *Proxy) ConfigureUpstreamTLS(cfg UpstreamTLSConfig) error {
+	policy := &upstreamTLSPolicy{minVersion: tls.VersionTLS12}
+
+	if len(cfg.RootCAs) > 0 {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		for _, path := range cfg.RootCAs {
+			certs, err := ca.ReadCertificates(path)
+			if err != nil {
+				return fmt.Errorf("failed to load upstream root %s: %v", path, err)
+			}
+			for _, cert := range certs {
+				roots.AddCert(cert)
+			}
+		}
+		policy.roots = roots
+	}
+
+	if cfg.MinVersion != "" {
+		version, err := ParseTLSVersion(cfg.MinVersion)
+		if err != nil {
+			return err
+		}
+		policy.minVersion = version
+	}
+
+	insecure, err := ParseHostPatterns(cfg.Insecure)
+	if err != nil {
+		return err
+	}
+	policy.insecure = insecure
+
+	for _, pin := range cfg.Pins {
+		pattern, err := ParseHostPattern(pin.Host)
+		if err != nil {
+			return err
+		}
+		if len(pin.SHA256) == 0 {
+			return fmt.Errorf("pin for %s has no fingerprints", pin.Host)
+		}
+		fingerprints := make(map[string]bool)
+		for _, fp := range pin.SHA256 {
+			fingerprints[normalizeFingerprint(fp)] = true
+		}
+		policy.pins = append(policy.pins, upstreamPin{pattern: pattern, fingerprints: fingerprints})
+	}
+
+	p.upstreamTLS = policy
+	return nil
+}
+
+// normalizeFingerprint strips separators and case from a hex fingerprint
+func normalizeFingerprint(fp string) string {
+	return strings.ToUpper(strings.NewReplacer(":", "", " ", "", "-", "").Replace(strings.TrimSpace(fp)))
+}
+
+// upstreamTLSConfig returns the client TLS configuration for connecting to host
+func (p *Proxy) upstreamTLSConfig(host string) *tls.Config {
+	policy := p.upstreamTLS
+	if policy == nil {
+		policy = &upstreamTLSPolicy{minVersion: tls.VersionTLS12}
+	}
+	return &tls.Config{
+		ServerName: host,
+		MinVersion: policy.minVersion,
+		// Verification is done in VerifyConnection so that failures carry the
+		// presented chain and per-host policy can be applied
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return policy.verify(host, cs)
+		},
+	}
+}
+
+// verify applies the upstream policy to a completed handshake with host.
+// The host is passed explicitly because ConnectionState.ServerName is empty
+// for IP addresses.
+func (u *upstreamTLSPolicy) verify(host string, cs tls.ConnectionState) error {
+	fail := func(err error) error {
+		return &UpstreamTLSError{Host: host, Chain: cs.PeerCertificates, Err: err}
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fail(errors.New("no certificate presented"))
+	}
+
+	if !u.isInsecure(host) {
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         u.roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, pin := range u.pins {
+		if !pin.pattern.Match(host) {
+			continue
+		}
+		for _, cert := range cs.PeerCertificates {
+			if pin.fingerprints[normalizeFingerprint(ca.Fingerprint(cert))] {
+				return nil
+			}
+		}
+		return fail(fmt.Errorf("no certificate matches the pinned fingerprints for %s", pin.pattern))
+	}
+	return nil
+}
+
+func (u *upstreamTLSPolicy) isInsecure(host string) bool {
+	for _, pattern := range u.insecure {
+		if pattern.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamTransports holds the transports used to re-originate requests
+type upstreamTransports struct {
+	http http.RoundTripper
+	h2   http.RoundTripper
+}
+
+// transportSet keeps one set of transports per forwarded client identity so
+// pooled connections are never shared between identities
+type transportSet struct {
+	mu         sync.Mutex
+	byIdentity map[*clientIdentity]*upstreamTransports
+}
+
+// transports returns the upstream transports for requests made on behalf of
+// forwarded (nil for none), creating them on first use
+func (p *Proxy) transports(forwarded *clientIdentity) *upstreamTransports {
+	set := &p.upstream
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if t, ok := set.byIdentity[forwarded]; ok {
+		return t
+	}
+	if set.byIdentity == nil {
+		set.byIdentity = make(map[*clientIdentity]*upstreamTransports)
+	}
+
+	h1 := http.DefaultTransport.(*http.Transport).Clone()
+	h1.MaxIdleConns = p.Pool.MaxIdleConns
+	h1.MaxIdleConnsPerHost = p.Pool.MaxIdleConnsPerHost
+	h1.MaxConnsPerHost = p.Pool.MaxConnsPerHost
+	h1.IdleConnTimeout = p.Pool.IdleTimeout
+	if p.upstreamProxies != nil {
+		h1.Proxy = p.httpProxyURL
+	}
+	h1.DialContext = p.dialUpstream
+	h1.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dialUpstreamTLS(ctx, network, addr, forwarded, "http/1.1")
+	}
+	h2 := &http2.Transport{
+		IdleConnTimeout: p.Pool.IdleTimeout,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return p.dialUpstreamTLS(ctx, network, addr, forwarded, http2.NextProtoTLS)
+		},
+	}
+
+	t := &upstreamTransports{
+		http: &trackedTransport{rt: h1, stats: &p.poolStats},
+		h2:   &trackedTransport{rt: h2, stats: &p.poolStats},
+	}
+	set.byIdentity[forwarded] = t
+	return t
+}
+
+// len returns the number of transport sets created so far
+func (set *transportSet) len() int {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	return len(set.byIdentity)
+}
+
+// upstreamErrorResponse builds the proxy-generated 502 page for a failed
+// upstream request, listing the presented chain when verification failed
+func upstreamErrorResponse(req *http.Request, err error) *http.Response {
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE html><html><head><title>502 Bad Gateway</title></head><body>")
+	b.WriteString("<h1>502 Bad Gateway</h1>")
+	fmt.Fprintf(&b, "<p>Interceptify could not complete the request to <code>%s</code>.</p>", html.EscapeString(req.Host))
+	fmt.Fprintf(&b, "<pre>%s</pre>", html.EscapeString(err.Error()))
+
+	var tlsErr *UpstreamTLSError
+	if errors.As(err, &tlsErr) && len(tlsErr.Chain) > 0 {
+		b.WriteString("<h2>Presented certificate chain</h2><ol>")
+		for _, cert := range tlsErr.Chain {
+			fmt.Fprintf(&b, "<li><pre>Subject:     %s\nIssuer:      %s\nDNS Names:   %s\nNot Before:  %s\nNot After:   %s\nSHA-256:     %s</pre></li>",
+				html.EscapeString(cert.Subject.String()),
+				html.EscapeString(cert.Issuer.String()),
+				html.EscapeString(strings.Join(cert.DNSNames, ", ")),
+				cert.NotBefore.UTC().Format("2006-01-02 15:04:05 MST"),
+				cert.NotAfter.UTC().Format("2006-01-02 15:04:05 MST"),
+				ca.Fingerprint(cert))
+		}
+		b.WriteString("</ol>")
+	}
+	b.WriteString("</body></html>")
+
+	body := b.String()
+	resp := &http.Response{
+		StatusCode:    http.StatusBadGateway,
+		Status:        "502 Bad Gateway",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	return resp
+}
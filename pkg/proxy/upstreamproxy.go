@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+// UpstreamDirect is the route that connects to upstream servers without a proxy
+const UpstreamDirect = "direct"
+
+// UpstreamProxyConfig chains the proxy's upstream connections through other
+// proxies. Proxy URLs are http://, https:// (HTTP CONNECT, with basic auth
+// from the user info) or socks5:// (with optional username/password).
+type UpstreamProxyConfig struct {
+	// Default is the URL of the proxy used for hosts no route matches; empty
+	// connects to them directly
+	Default string
+	// Proxies maps the names used by routes to proxy URLs
+	Proxies map[string]string
+	// Routes send matching hosts directly or through a named proxy; the
+	// first match wins
+	Routes []UpstreamRouteConfig
+}
+
+// UpstreamRouteConfig routes hosts matching Host via UpstreamDirect or a
+// named upstream proxy
+type UpstreamRouteConfig struct {
+	Host string `mapstructure:"host"`
+	Via  string `mapstructure:"via"`
+}
+
+// upstreamProxy is a parsed upstream proxy
+type upstreamProxy struct {
+	name string
+	url  *url.URL
+	// socks dials through a SOCKS5 proxy; nil for HTTP proxies
+	socks xproxy.ContextDialer
+}
+
+type upstreamRoute struct {
+	pattern HostPattern
+	// via is nil for direct connections
+	via *upstreamProxy
+}
+
+// upstreamProxyRoutes is the compiled form of UpstreamProxyConfig
+type upstreamProxyRoutes struct {
+	fallback *upstreamProxy
+	routes   []upstreamRoute
+}
+
+// ConfigureUpstreamProxies sets how the proxy reaches upstream servers. It
+// must be called before serving.
+func (p *Proxy) ConfigureUpstreamProxies(cfg UpstreamProxyConfig) error {
+	routes := &upstreamProxyRoutes{}
+
+	named := make(map[string]*upstreamProxy, len(cfg.Proxies))
+	for name, rawURL := range cfg.Proxies {
+		name = strings.ToLower(name)
+		if name == UpstreamDirect {
+			return fmt.Errorf("upstream proxy name %q is reserved", name)
+		}
+		up, err := parseUpstreamProxy(name, rawURL)
+		if err != nil {
+			return err
+		}
+		named[name] = up
+	}
+
+	if cfg.Default != "" {
+		up, err := parseUpstreamProxy("default", cfg.Default)
+		if err != nil {
+			return err
+		}
+		routes.fallback = up
+	}
+
+	for _, route := range cfg.Routes {
+		pattern, err := ParseHostPattern(route.Host)
+		if err != nil {
+			return err
+		}
+		via := strings.ToLower(strings.TrimSpace(route.Via))
+		if via == UpstreamDirect {
+			routes.routes = append(routes.routes, upstreamRoute{pattern: pattern})
+			continue
+		}
+		up, ok := named[via]
+		if !ok {
+			return fmt.Errorf("route for %s uses unknown upstream proxy %q", route.Host, route.Via)
+		}
+		routes.routes = append(routes.routes, upstreamRoute{pattern: pattern, via: up})
+	}
+
+	p.upstreamProxies = routes
+	return nil
+}
+
+// parseUpstreamProxy parses the URL of an upstream proxy
+func parseUpstreamProxy(name, rawURL string) (*upstreamProxy, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %s: %v", name, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid upstream proxy %s: %q has no host", name, rawURL)
+	}
+
+	up := &upstreamProxy{name: name, url: u}
+	switch u.Scheme {
+	case "http":
+		u.Host = withDefaultPort(u.Host, "80")
+	case "https":
+		u.Host = withDefaultPort(u.Host, "443")
+	case "socks5", "socks5h":
+		u.Host = withDefaultPort(u.Host, "1080")
+		dialer, err := xproxy.FromURL(u, &net.Dialer{Timeout: upstreamDialTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy %s: %v", name, err)
+		}
+		up.socks = dialer.(xproxy.ContextDialer)
+	default:
+		return nil, fmt.Errorf("invalid upstream proxy %s: unsupported scheme %q (expected http, https or socks5)", name, u.Scheme)
+	}
+	return up, nil
+}
+
+// upstreamProxyFor returns the proxy that connections to host go through,
+// or nil to connect directly
+func (p *Proxy) upstreamProxyFor(host string) *upstreamProxy {
+	routes := p.upstreamProxies
+	if routes == nil {
+		return nil
+	}
+	for _, route := range routes.routes {
+		if route.pattern.Match(host) {
+			return route.via
+		}
+	}
+	return routes.fallback
+}
+
+// httpProxyURL selects the upstream proxy for a plain HTTP request made by
+// the shared transport. HTTP proxies are sent the request in absolute form;
+// everything else is reached through dialUpstream.
+func (p *Proxy) httpProxyURL(req *http.Request) (*url.URL, error) {
+	if req.URL.Scheme != "http" {
+		return nil, nil
+	}
+	if up := p.upstreamProxyFor(req.URL.Hostname()); up != nil && up.socks == nil {
+		return up.url, nil
+	}
+	return nil, nil
+}
+
+// dialUpstream connects to addr, directly or through the upstream proxy its
+// host is routed to
+func (p *Proxy) dialUpstream(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := p.parked.take(network, addr); conn != nil {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamDialTimeout)
+	defer cancel()
+
+	up := p.upstreamProxyFor(stripPort(addr))
+	if up == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, addr)
+	}
+	conn, err := up.dial(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("upstream proxy %s: %v", up.name, err)
+	}
+	return conn, nil
+}
+
+// dialUpstreamTLSConfig connects to addr with dialUpstream and completes a
+// TLS handshake using cfg
+func (p *Proxy) dialUpstreamTLSConfig(ctx context.Context, network, addr string, cfg *tls.Config) (*tls.Conn, error) {
+	conn, err := p.dialUpstream(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, upstreamDialTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dial opens a tunnel to addr through the upstream proxy
+func (up *upstreamProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if up.socks != nil {
+		return up.socks.DialContext(ctx, network, addr)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", up.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	if up.url.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: up.url.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	tunnel, err := up.connect(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+// connect asks an HTTP proxy to open a CONNECT tunnel to addr over conn
+func (up *upstreamProxy) connect(ctx context.Context, conn net.Conn, addr string) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := up.url.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CONNECT to %s refused: %s", addr, resp.Status)
+	}
+	// The proxy may already have relayed the first bytes from the server
+	return &bufferedConn{Conn: conn, r: reader}, nil
+}
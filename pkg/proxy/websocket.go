@@ -0,0 +1,451 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ismailtsdln/interceptify/pkg/plugins"
+)
+
+const (
+	// maxWebSocketPayload bounds the size of a single relayed frame
+	maxWebSocketPayload = 16 << 20
+	// webSocketHistory bounds how many connections are kept for the dashboard
+	webSocketHistory = 100
+	// webSocketMessageHistory bounds how many frames are kept per connection
+	webSocketMessageHistory = 1000
+	// webSocketPreview is how much of each payload the dashboard shows
+	webSocketPreview = 256
+)
+
+var errWebSocketClosed = errors.New("websocket connection closed")
+
+// isWebSocket reports whether req is an HTTP/1.1 WebSocket opening handshake
+func isWebSocket(req *http.Request) bool {
+	return isUpgrade(req) && strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// isWebSocketH2 reports whether req opens a WebSocket over h2 with
+// extended CONNECT (RFC 8441)
+func isWebSocketH2(req *http.Request) bool {
+	return req.Method == http.MethodConnect && strings.EqualFold(req.Header.Get(":protocol"), "websocket")
+}
+
+// readWebSocketFrame reads one frame from r and unmasks its payload
+func readWebSocketFrame(r io.Reader) (*plugins.WebSocketMessage, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	msg := &plugins.WebSocketMessage{Fin: header[0]&0x80 != 0, Opcode: header[0] & 0x0f}
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > maxWebSocketPayload {
+		return nil, fmt.Errorf("websocket frame of %d bytes exceeds the %d byte limit", length, maxWebSocketPayload)
+	}
+
+	var key [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	msg.Payload = make([]byte, length)
+	if _, err := io.ReadFull(r, msg.Payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		maskWebSocketPayload(key, msg.Payload)
+	}
+	return msg, nil
+}
+
+// writeWebSocketFrame writes msg to w as a single frame, masking it with a
+// fresh key when mask is set
+func writeWebSocketFrame(w io.Writer, msg *plugins.WebSocketMessage, mask bool) error {
+	first := msg.Opcode & 0x0f
+	if msg.Fin {
+		first |= 0x80
+	}
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+
+	frame := []byte{first}
+	switch n := len(msg.Payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if !mask {
+		_, err := w.Write(append(frame, msg.Payload...))
+		return err
+	}
+	var key [4]byte
+	rand.Read(key[:])
+	frame = append(frame, key[:]...)
+	start := len(frame)
+	frame = append(frame, msg.Payload...)
+	maskWebSocketPayload(key, frame[start:])
+	_, err := w.Write(frame)
+	return err
+}
+
+// maskWebSocketPayload masks or unmasks b in place
+func maskWebSocketPayload(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
+
+// newWebSocketKey returns a random Sec-WebSocket-Key value
+func newWebSocketKey() string {
+	var key [16]byte
+	rand.Read(key[:])
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// wsPeer writes frames to one side of an intercepted WebSocket connection
+type wsPeer struct {
+	mu sync.Mutex
+	w  io.Writer
+	// mask is set for the server side; frames sent by a client are masked
+	mask   bool
+	closed bool
+}
+
+func (peer *wsPeer) write(msg *plugins.WebSocketMessage) error {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	if peer.closed {
+		return errWebSocketClosed
+	}
+	if err := writeWebSocketFrame(peer.w, msg, peer.mask); err != nil {
+		return err
+	}
+	if f, ok := peer.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (peer *wsPeer) close() {
+	peer.mu.Lock()
+	defer peer.mu.Unlock()
+	peer.closed = true
+}
+
+// webSocketSession relays the frames of one intercepted WebSocket
+// connection. It implements plugins.WebSocketConn.
+type webSocketSession struct {
+	p      *Proxy
+	id     uint64
+	req    *http.Request
+	client wsPeer
+	server wsPeer
+}
+
+func (s *webSocketSession) ID() uint64             { return s.id }
+func (s *webSocketSession) Request() *http.Request { return s.req }
+
+func (s *webSocketSession) Inject(msg *plugins.WebSocketMessage) error {
+	return s.send(msg, true)
+}
+
+// send writes msg towards the server if it comes from the client, and
+// towards the client otherwise
+func (s *webSocketSession) send(msg *plugins.WebSocketMessage, injected bool) error {
+	peer := &s.client
+	if msg.FromClient {
+		peer = &s.server
+	}
+	if err := peer.write(msg); err != nil {
+		return err
+	}
+	s.p.webSockets.record(s.id, msg, false, injected)
+	return nil
+}
+
+// pump relays the frames read from r through the plugin hooks
+func (s *webSocketSession) pump(r io.Reader, fromClient bool) error {
+	for {
+		msg, err := readWebSocketFrame(r)
+		if err != nil {
+			return err
+		}
+		msg.FromClient = fromClient
+
+		out := s.p.Plugins.RunWebSocketHooks(s, msg)
+		if out == nil {
+			s.p.webSockets.record(s.id, msg, true, false)
+			continue
+		}
+		if err := s.send(out, false); err != nil {
+			return err
+		}
+	}
+}
+
+// relayWebSocket relays frames between the client and the upstream until
+// either side stops, then closes both
+func (p *Proxy) relayWebSocket(ex exchange, req *http.Request, client io.Reader, clientW io.Writer, closeClient func() error, upstream io.ReadWriteCloser) {
+	s := &webSocketSession{
+		p:      p,
+		req:    req,
+		client: wsPeer{w: clientW},
+		server: wsPeer{w: upstream, mask: true},
+	}
+	s.id = p.webSockets.open(ex, req)
+	log.Printf("WebSocket %d opened: %s", s.id, req.URL.String())
+	p.logEvent(fmt.Sprintf("WEBSOCKET: %s opened", req.URL.String()))
+
+	errc := make(chan error, 2)
+	go func() { errc <- s.pump(client, true) }()
+	go func() { errc <- s.pump(upstream, false) }()
+	err := <-errc
+
+	s.client.close()
+	s.server.close()
+	closeClient()
+	upstream.Close()
+	<-errc
+
+	frames := p.webSockets.finish(s.id, err)
+	p.logEvent(fmt.Sprintf("WEBSOCKET: %s closed frames=%d", req.URL.String(), frames))
+}
+
+// handleWebSocket completes an HTTP/1.1 WebSocket handshake upstream and
+// relays the connection's frames
+func (p *Proxy) handleWebSocket(conn *bufferedConn, ex exchange, req *http.Request) {
+	resp := p.roundTrip(ex, req)
+	defer resp.Body.Close()
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		// The upgrade was refused; answer like any other request
+		writeProxyResponse(conn, req, resp)
+		return
+	}
+
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", "websocket")
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return
+	}
+	if err := resp.Header.Write(conn); err != nil {
+		return
+	}
+	if _, err := io.WriteString(conn, "\r\n"); err != nil {
+		return
+	}
+
+	p.relayWebSocket(ex, req, conn, conn, conn.Close, upstream)
+}
+
+// handleWebSocketH2 serves a WebSocket that an h2 client opened with
+// extended CONNECT. The upstream is always reached with an HTTP/1.1 upgrade.
+func (p *Proxy) handleWebSocketH2(w http.ResponseWriter, req *http.Request, ex exchange) {
+	handshake := req.Clone(req.Context())
+	handshake.Method = http.MethodGet
+	handshake.Header.Del(":protocol")
+	handshake.Header.Set("Connection", "Upgrade")
+	handshake.Header.Set("Upgrade", "websocket")
+	handshake.Header.Set("Sec-WebSocket-Key", newWebSocketKey())
+	handshake.Body = http.NoBody
+	handshake.ContentLength = 0
+
+	resp := p.roundTrip(ex, handshake)
+	defer resp.Body.Close()
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if resp.StatusCode != http.StatusSwitchingProtocols || !ok {
+		copyResponse(w, resp)
+		return
+	}
+
+	// Over h2 the stream itself is accepted with a 200 and no key exchange
+	resp.Header.Del("Sec-WebSocket-Accept")
+	for k, vv := range resp.Header {
+		w.Header()[k] = vv
+	}
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	p.relayWebSocket(ex, req, req.Body, w, req.Body.Close, upstream)
+}
+
+// WebSocketConnection records an intercepted WebSocket connection
+type WebSocketConnection struct {
+	ID     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	URL    string    `json:"url"`
+	// Proto is the protocol spoken with the client (HTTP, HTTPS or HTTPS/2)
+	Proto    string           `json:"proto"`
+	Open     bool             `json:"open"`
+	Error    string           `json:"error,omitempty"`
+	Messages []WebSocketFrame `json:"messages"`
+}
+
+// WebSocketFrame records one frame of an intercepted WebSocket connection
+type WebSocketFrame struct {
+	Time       time.Time `json:"time"`
+	FromClient bool      `json:"from_client"`
+	Opcode     string    `json:"opcode"`
+	Length     int       `json:"length"`
+	// Payload is the start of the payload: text as-is, anything else in hex
+	Payload string `json:"payload"`
+	// Dropped is set for frames a plugin dropped
+	Dropped bool `json:"dropped,omitempty"`
+	// Injected is set for frames a plugin injected
+	Injected bool `json:"injected,omitempty"`
+}
+
+// webSocketOpcodes names the opcodes shown on the dashboard
+var webSocketOpcodes = map[byte]string{
+	plugins.OpContinuation: "continuation",
+	plugins.OpText:         "text",
+	plugins.OpBinary:       "binary",
+	plugins.OpClose:        "close",
+	plugins.OpPing:         "ping",
+	plugins.OpPong:         "pong",
+}
+
+// newWebSocketFrame summarises msg for the dashboard
+func newWebSocketFrame(msg *plugins.WebSocketMessage) WebSocketFrame {
+	frame := WebSocketFrame{
+		Time:       time.Now(),
+		FromClient: msg.FromClient,
+		Opcode:     webSocketOpcodes[msg.Opcode],
+		Length:     len(msg.Payload),
+	}
+	if frame.Opcode == "" {
+		frame.Opcode = fmt.Sprintf("0x%x", msg.Opcode)
+	}
+
+	payload := msg.Payload
+	if len(payload) > webSocketPreview {
+		payload = payload[:webSocketPreview]
+	}
+	if msg.Opcode == plugins.OpText {
+		frame.Payload = strings.ToValidUTF8(string(payload), "�")
+	} else {
+		frame.Payload = hex.EncodeToString(payload)
+	}
+	return frame
+}
+
+// webSocketLog keeps the most recent WebSocket connections
+type webSocketLog struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  []*WebSocketConnection
+}
+
+// open starts the record of a connection and returns its ID
+func (l *webSocketLog) open(ex exchange, req *http.Request) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.nextID++
+	l.conns = append(l.conns, &WebSocketConnection{
+		ID:     l.nextID,
+		Time:   time.Now(),
+		Client: ex.client,
+		URL:    req.URL.String(),
+		Proto:  ex.proto,
+		Open:   true,
+	})
+	if len(l.conns) > webSocketHistory {
+		l.conns = l.conns[len(l.conns)-webSocketHistory:]
+	}
+	return l.nextID
+}
+
+// lookup returns the record of connection id, if it is still kept
+func (l *webSocketLog) lookup(id uint64) *WebSocketConnection {
+	for i := len(l.conns) - 1; i >= 0; i-- {
+		if l.conns[i].ID == id {
+			return l.conns[i]
+		}
+	}
+	return nil
+}
+
+func (l *webSocketLog) record(id uint64, msg *plugins.WebSocketMessage, dropped, injected bool) {
+	frame := newWebSocketFrame(msg)
+	frame.Dropped, frame.Injected = dropped, injected
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conn := l.lookup(id)
+	if conn == nil {
+		return
+	}
+	conn.Messages = append(conn.Messages, frame)
+	if len(conn.Messages) > webSocketMessageHistory {
+		conn.Messages = conn.Messages[len(conn.Messages)-webSocketMessageHistory:]
+	}
+}
+
+// finish marks connection id closed and returns how many frames it recorded
+func (l *webSocketLog) finish(id uint64, err error) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conn := l.lookup(id)
+	if conn == nil {
+		return 0
+	}
+	conn.Open = false
+	if err != nil && err != io.EOF && !errors.Is(err, errWebSocketClosed) {
+		conn.Error = err.Error()
+	}
+	return len(conn.Messages)
+}
+
+// WebSockets returns the most recent WebSocket connections and their
+// frames, oldest first
+func (p *Proxy) WebSockets() []WebSocketConnection {
+	l := &p.webSockets
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conns := make([]WebSocketConnection, len(l.conns))
+	for i, conn := range l.conns {
+		conns[i] = *conn
+		conns[i].Messages = append([]WebSocketFrame(nil), conn.Messages...)
+	}
+	return conns
+}